@@ -31,27 +31,67 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
 	"strings"
+	"syscall"
+	"text/template"
+	"unicode"
 )
 
 type Cli struct {
-	version        string
-	rootCommand    *Command
-	defaultCommand *Command
-	preRunCommand  func(context.Context, *Cli) error
-	bannerFunction func(context.Context, *Cli) string
-	errorHandler   func(string, error) error
-	helpHandler    func(context.Context, *Cli) error
+	version         string
+	rootCommand     *Command
+	defaultCommand  *Command
+	preRunCommand   func(context.Context, *Cli) error
+	preRunFor       func(context.Context, *Cli, string) error
+	preflights      map[string][]func(context.Context) error
+	bannerFunction  func(context.Context, *Cli) string
+	errorHandler    func(string, error) error
+	helpHandler     func(context.Context, *Cli) error
+	persistentFlags *flagSet // flags accepted by every command
+	chdirFlag       bool
+	allowedNames    map[string]bool // reserved command names allowed
+	presets         map[string][]string
+	requestID       bool
+	outputTransform func(string) string
+	explainFlags    bool
+	explicitBools   bool
+	translator      func(string, ...interface{}) string
+	errorTransform  func(error) error
+	trimOutput      bool
+	encoders        map[string]func(interface{}) ([]byte, error)
+	originalName    string // root name before ResolveNameFromArgv0
+	argv0Dispatch   bool
+	bufferOutput    bool
+	stdoutWrapper   func(io.Writer) io.Writer
+	outputFileFlag  bool
+	echoCommands    bool
+	verbosityFlag   bool
+	verboseHelp     bool
+	helpIsError     bool
+	color           bool
+	metrics         *metrics
+	flagsFile       bool
+	flagTemplates   bool
+	stdinCommand    *Command
+	helpTemplate    *template.Template
+
+	beginTransaction func(context.Context) (context.Context, func(error) error, error)
 }
 
 // NewCli - Creates a new Cli application object
 func NewCli(name, description, version string) *Cli {
 	result := &Cli{
-		version:        version,
-		bannerFunction: defaultBannerFunction,
+		version:         version,
+		bannerFunction:  defaultBannerFunction,
+		persistentFlags: newFlagSet(),
 	}
 	result.rootCommand = NewCommand(name, description)
-	result.rootCommand.app = result // the only place app is set
+	result.rootCommand.app = result // the only place app is set; cleared by Mount
 	return result
 }
 
@@ -70,9 +110,13 @@ func (c *Cli) ShortDescription() string {
 	return c.rootCommand.shortdescription
 }
 
-// PrintBanner - Prints the application banner!
+// PrintBanner - Prints the application banner! It goes to Stderr(ctx) when
+// printing JSON, to keep the output valid.
 func (c *Cli) PrintBanner(ctx context.Context) {
 	out := Stdout(ctx)
+	if PrintsJson(ctx) {
+		out = Stderr(ctx)
+	}
 	fmt.Fprintln(out, c.bannerFunction(ctx, c))
 	fmt.Fprintln(out)
 }
@@ -82,15 +126,123 @@ func (c *Cli) PrintHelp(ctx context.Context) {
 	c.rootCommand.PrintHelp(ctx)
 }
 
+// HelpString - Returns the application's help as PrintHelp outputs it.
+func (c *Cli) HelpString(ctx context.Context) string {
+	return c.rootCommand.HelpString(ctx)
+}
+
+// Synopsis - Returns the one-line usage of the application, such as
+// "app [flags] <command>"
+func (c *Cli) Synopsis() string {
+	return c.rootCommand.Synopsis()
+}
+
 // Run - Runs the application with the given arguments.
 func (c *Cli) Run(ctx context.Context, args ...string) error {
+	err := c.run(ctx, args)
+	if err == ErrHelp && !c.helpIsError {
+		return nil
+	}
+	if err != nil && c.errorTransform != nil {
+		err = c.errorTransform(err)
+	}
+	return err
+}
+
+// RunWithFlags runs like Run, as if the flags of the command run were set to the
+// given values, unless given in args. It fails on names that are not flags of
+// the command.
+func (c *Cli) RunWithFlags(ctx context.Context, flags map[string]interface{}, args ...string) error {
+	return c.Run(context.WithValue(ctx, SeedFlagsKey, flags), args...)
+}
+
+// RunWithSignals runs like Run, with the context canceled on SIGINT or SIGTERM
+// so that actions honoring ctx.Done() can stop cleanly. The default handling of
+// the signals is restored when it returns.
+func (c *Cli) RunWithSignals(ctx context.Context, args ...string) error {
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return c.Run(ctx, args...)
+}
+
+// RunChan runs the command in a goroutine, passing on the items its action
+// sends to Stream(ctx). The item channel is closed when the command returns,
+// after which the error channel delivers the result, nil on success, and is
+// closed. Callers should drain the item channel before waiting for the error,
+// or cancel ctx and have the action stop sending.
+func (c *Cli) RunChan(ctx context.Context, args ...string) (<-chan interface{}, <-chan error) {
+	items := make(chan interface{})
+	errc := make(chan error, 1)
+	go func() {
+		defer close(errc)
+		err := c.Run(context.WithValue(ctx, StreamKey, items), args...)
+		close(items)
+		errc <- err
+	}()
+	return items, errc
+}
+
+func (c *Cli) run(ctx context.Context, args []string) error {
+	ctx = context.WithValue(ctx, CliKey, c)
+	if c.argv0Dispatch {
+		name := c.rootCommand.name
+		if _, ok := c.rootCommand.subCommandsMap[name]; ok {
+			args = append([]string{name}, args...)
+		}
+	}
+	if c.requestID && RequestID(ctx) == "" {
+		ctx = WithRequestID(ctx, newRequestID())
+	}
 	if c.preRunCommand != nil {
 		err := c.preRunCommand(ctx, c)
 		if err != nil {
 			return err
 		}
 	}
-	return c.rootCommand.run(ctx, args)
+	if c.preRunFor != nil {
+		if err := c.preRunFor(ctx, c, c.rootCommand.resolvePath(args)); err != nil {
+			return err
+		}
+	}
+	return c.rootCommand.run(ctx, args, 0)
+}
+
+// argv0 returns the name the program is invoked with; replaced in tests.
+var argv0 = func() string {
+	return os.Args[0]
+}
+
+// ResolveNameFromArgv0 - Sets whether the application takes its name from the
+// program name, e.g. when invoked through a symlink. Busybox-style, a run then
+// dispatches to the subcommand of the same name, if any.
+func (c *Cli) ResolveNameFromArgv0(enabled bool) *Cli {
+	if enabled && !c.argv0Dispatch {
+		c.originalName = c.rootCommand.name
+		c.rootCommand.name = filepath.Base(argv0())
+	} else if !enabled && c.argv0Dispatch {
+		c.rootCommand.name = c.originalName
+	}
+	c.argv0Dispatch = enabled
+	return c
+}
+
+// Validate - Checks the command tree for names clashing with the reserved ones,
+// such as a command or a flag named "help". It is meant to be called once at
+// startup, after all commands are added.
+func (c *Cli) Validate() error {
+	return c.rootCommand.validate(c, maxDepth)
+}
+
+// AllowReserved - Allows commands to use the given reserved names, which then
+// take precedence. Flags can never use reserved names.
+func (c *Cli) AllowReserved(names ...string) *Cli {
+	if c.allowedNames == nil {
+		c.allowedNames = make(map[string]bool)
+	}
+	for _, name := range names {
+		c.allowedNames[name] = true
+	}
+	return c
 }
 
 // NewSubCommand - Creates a new SubCommand for the application.
@@ -98,11 +250,50 @@ func (c *Cli) NewSubCommand(name, description string) *Command {
 	return c.rootCommand.NewSubCommand(name, description)
 }
 
+// VersionCommand - Adds the `version` command printing the banner, or only the
+// version with --short.
+func (c *Cli) VersionCommand() *Command {
+	return c.NewSubCommand("version", "Print the version").
+		BoolFlag("short", "Print only the version number.", false).
+		Action(func(ctx context.Context) error {
+			if BoolFlag(ctx, "short", false) {
+				return Println(ctx, c.version)
+			}
+			return Println(ctx, c.bannerFunction(ctx, c))
+		})
+}
+
+// WithRequestID - Sets whether each run gets a unique ID, read with RequestID.
+// An ID already in the context is kept.
+func (c *Cli) WithRequestID(enabled bool) *Cli {
+	c.requestID = enabled
+	return c
+}
+
 // PreRun - Calls the given function before running the specific command.
 func (c *Cli) PreRun(callback func(context.Context, *Cli) error) {
 	c.preRunCommand = callback
 }
 
+// PreRunForCommand - Calls the given function before running a command, after
+// the one given to PreRun, with the space-separated path of the subcommand to
+// run, e.g. "remote add", or "" for the root, so it can skip some commands.
+func (c *Cli) PreRunForCommand(callback func(ctx context.Context, cli *Cli, path string) error) *Cli {
+	c.preRunFor = callback
+	return c
+}
+
+// PreflightForTag - Adds a check run before the action of each command tagged
+// with tag by Command.Tag, e.g. for network access. The command fails with the
+// error of the first failing check without running its action.
+func (c *Cli) PreflightForTag(tag string, check func(ctx context.Context) error) *Cli {
+	if c.preflights == nil {
+		c.preflights = make(map[string][]func(context.Context) error)
+	}
+	c.preflights[tag] = append(c.preflights[tag], check)
+	return c
+}
+
 // BoolFlag - Adds a boolean flag to the root command.
 func (c *Cli) BoolFlag(name, description string, variable bool, ptr ...*bool) *Cli {
 	c.rootCommand.BoolFlag(name, description, variable, ptr...)
@@ -121,6 +312,218 @@ func (c *Cli) IntFlag(name, description string, variable int, ptr ...*int) *Cli
 	return c
 }
 
+// ChdirFlag - Adds the persistent --chdir (or -C) flag to all commands. When given,
+// the working directory is changed to it before running the action and restored
+// afterward. Note that the working directory is process-wide, so commands using
+// it should not run concurrently.
+func (c *Cli) ChdirFlag() *Cli {
+	c.persistentFlags.addFlag("chdir", "Change to directory before running the command.", "", nil)
+	c.persistentFlags.addFlag("C", "Same as --chdir.", "", nil)
+	c.chdirFlag = true
+	return c
+}
+
+// OutputFileFlag - Adds the persistent --output (or -o) flag to all commands.
+// When given, the output of the action is written to the file instead.
+func (c *Cli) OutputFileFlag() *Cli {
+	c.persistentFlags.addFlag("output", "Write the output to the file.", "", nil)
+	c.persistentFlags.addFlag("o", "Same as --output.", "", nil)
+	c.outputFileFlag = true
+	return c
+}
+
+// Color - Sets whether output helpers such as PrintDiff may color their output
+// when writing to a terminal; see UsesColor. It is off by default.
+func (c *Cli) Color(enabled bool) *Cli {
+	c.color = enabled
+	return c
+}
+
+// HelpIsError - Sets whether Run returns ErrHelp after printing help when no
+// command is given, rather than nil. It is off by default, as printing help is
+// a normal outcome.
+func (c *Cli) HelpIsError(enabled bool) *Cli {
+	c.helpIsError = enabled
+	return c
+}
+
+// HelpTemplate - Sets the text/template rendering help instead of the built-in
+// layout, given the HelpData of the command. It fails, leaving the template
+// unchanged, if tmpl is invalid.
+func (c *Cli) HelpTemplate(tmpl string) error {
+	t, err := template.New("help").Parse(tmpl)
+	if err != nil {
+		return fmt.Errorf("Invalid help template: %w", err)
+	}
+	c.helpTemplate = t
+	return nil
+}
+
+// VerboseHelp - Sets whether help lists the long descriptions of subcommands
+// under their short ones. It is also done for the help of a run with the flag
+// of VerbosityFlag, as in --help -v.
+func (c *Cli) VerboseHelp(enabled bool) *Cli {
+	c.verboseHelp = enabled
+	return c
+}
+
+// VerbosityFlag - Adds the persistent --verbose (or -v) flag to all commands,
+// counting its occurrences as in -v -v or -vv, read with Verbosity.
+func (c *Cli) VerbosityFlag() *Cli {
+	c.persistentFlags.addFlag("verbose", "Increase verbosity; may be repeated.", countFlag(0), nil)
+	c.persistentFlags.addFlag("v", "Same as --verbose, also as -vv or -vvv.", countFlag(0), nil)
+	c.verbosityFlag = true
+	return c
+}
+
+// Preset - Defines a named bundle of arguments, which replaces `--preset name`
+// given among the flags of any command.
+func (c *Cli) Preset(name string, args ...string) *Cli {
+	if c.presets == nil {
+		c.presets = make(map[string][]string)
+	}
+	c.presets[name] = args
+	return c
+}
+
+// FlagTemplates - Sets whether string flag values are rendered as text
+// templates with the values of all flags as data, such as
+// `--url https://{{.host}}:{{.port}}`, after parsing. Templates can reference
+// other templates, but not cyclically. It is off by default.
+func (c *Cli) FlagTemplates(enabled bool) *Cli {
+	c.flagTemplates = enabled
+	return c
+}
+
+// FlagsFile - Enables `--flags-file path` among the flags of all commands, for
+// the flags in the file, one `--name value` per line, skipping blank lines and
+// those starting with "#". The flags in the file go before all the flags on the
+// command line, rather than at the position of `--flags-file`, so that those on
+// the command line take precedence wherever given.
+func (c *Cli) FlagsFile() *Cli {
+	c.flagsFile = true
+	return c
+}
+
+// expandArgs replaces the presets in the leading flags of args, those of the
+// command with flags, with their arguments. The arguments of flags files go
+// first instead, so that the flags given on the command line win. Arguments
+// after the flags, as for the action, are kept as is.
+func (c *Cli) expandArgs(args []string, flags *flagSet) ([]string, error) {
+	if len(c.presets) == 0 && !c.flagsFile {
+		return args, nil
+	}
+
+	var fileArgs []string
+	ret := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		name, hasValue, ok := flagName(arg)
+		if !ok {
+			ret = append(ret, args[i:]...)
+			break
+		}
+
+		if len(c.presets) > 0 {
+			if name, next, ok, err := optionArg(args, i, "preset"); err != nil {
+				return nil, err
+			} else if ok {
+				preset, ok := c.presets[name]
+				if !ok {
+					return nil, fmt.Errorf("unknown preset: %s", name)
+				}
+				ret = append(ret, preset...)
+				i = next
+				continue
+			}
+		}
+		if c.flagsFile {
+			if path, next, ok, err := optionArg(args, i, "flags-file"); err != nil {
+				return nil, err
+			} else if ok {
+				flags, err := readFlagsFile(path)
+				if err != nil {
+					return nil, err
+				}
+				fileArgs = append(fileArgs, flags...)
+				i = next
+				continue
+			}
+		}
+		ret = append(ret, arg)
+		if proto := flags.lookup(name, c.persistentFlags); proto != nil && !hasValue && i+1 < len(args) {
+			switch proto.value.(type) {
+			case bool, countFlag:
+			default:
+				ret = append(ret, args[i+1]) // skip the value
+				i++
+			}
+		}
+	}
+	return append(fileArgs, ret...), nil
+}
+
+// optionArg returns the value of the option name at args[i], given as
+// `-name value` or `-name=value` with one or two dashes, and the index of its
+// last argument, or false if args[i] is not the option.
+func optionArg(args []string, i int, name string) (string, int, bool, error) {
+	arg := args[i]
+	switch {
+	case arg == "-"+name || arg == "--"+name:
+		if i+1 == len(args) {
+			return "", i, false, fmt.Errorf("flag needs an argument: %s", arg)
+		}
+		return args[i+1], i + 1, true, nil
+	case strings.HasPrefix(arg, "-"+name+"="):
+		return arg[len(name)+2:], i, true, nil
+	case strings.HasPrefix(arg, "--"+name+"="):
+		return arg[len(name)+3:], i, true, nil
+	}
+	return "", i, false, nil
+}
+
+// readFlagsFile returns the arguments of the flags in the file at path, one
+// `--name value` per line, with the value taking the rest of the line.
+func readFlagsFile(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var args []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if i := strings.IndexAny(line, " \t"); i >= 0 {
+			args = append(args, line[:i], strings.TrimSpace(line[i+1:]))
+		} else {
+			args = append(args, line)
+		}
+	}
+	return args, nil
+}
+
+// ExplainFlags - Sets whether to add the persistent --explain-flags flag, which
+// prints the value of each flag and its source instead of running the action.
+func (c *Cli) ExplainFlags(enabled bool) *Cli {
+	if enabled {
+		c.persistentFlags.addFlag("explain-flags", "Print flag values and their sources, then exit.", false, nil)
+	} else {
+		delete(c.persistentFlags.protos, "explain-flags")
+	}
+	c.explainFlags = enabled
+	return c
+}
+
+// ExplicitBoolValues - Sets whether bool flags take a following true, false, 1 or
+// 0 as their value, as in `--verbose true`. It is off by default, since such a
+// value is otherwise the first positional argument.
+func (c *Cli) ExplicitBoolValues(enabled bool) *Cli {
+	c.explicitBools = enabled
+	return c
+}
+
 // Action - Define an action from this command.
 func (c *Cli) Action(callback Action) *Cli {
 	c.rootCommand.Action(callback)
@@ -139,13 +542,46 @@ func (c *Cli) Commands(commands ...*Command) *Cli {
 	return c
 }
 
+// RegisterFactory - Adds the commands produced by the factory, such as commands
+// generated from data.
+func (c *Cli) RegisterFactory(factory func() []*Command) *Cli {
+	return c.Commands(factory()...)
+}
+
+// Mount - Adds the command tree of sub as the subcommand named name, with its
+// commands, flags and default command, if a direct subcommand. The commands then
+// run with the settings of this application rather than those of sub, which
+// should no longer be used on its own.
+func (c *Cli) Mount(name string, sub *Cli) *Cli {
+	root := sub.rootCommand
+	root.app = nil
+	root.name = name
+	if def := sub.defaultCommand; def != nil && def.parent == root && root.defaultSubCommand == nil {
+		root.defaultSubCommand = def
+	}
+	c.rootCommand.AddCommand(root)
+	return c
+}
+
 // DefaultCommand - Sets the given command as the command to run when
-// no other commands given.
+// no other commands given, also with the flags given without a command,
+// e.g. `app --fmt json`, unless the root command has an action. Flags of
+// the root command are parsed by the root, with their values seen by the
+// default command. The flags of both cannot be mixed, as in
+// `app --fmt json --limit 3` with --limit of the default command, which
+// fails as an undefined flag of the root.
 func (c *Cli) DefaultCommand(defaultCommand *Command) *Cli {
 	c.defaultCommand = defaultCommand
 	return c
 }
 
+// StdinCommand - Sets the command to run when no command is given and the
+// input is piped, as by StdinIsPipe, rather than the default command or help.
+func (c *Cli) StdinCommand(command *Command) *Cli {
+	c.stdinCommand = command
+	return c
+}
+
 // BannerFunction - Set the function that is called
 // to get the banner string.
 func (c *Cli) BannerFunction(fn func(context.Context, *Cli) string) *Cli {
@@ -161,6 +597,75 @@ func (c *Cli) ErrorFunction(fn func(string, error) error) *Cli {
 	return c
 }
 
+// TrimOutput - Sets whether RunBuffer, and so RunLine and RunUnmarshal, trims
+// leading and trailing whitespace from the output. It is off by default.
+func (c *Cli) TrimOutput(enabled bool) *Cli {
+	c.trimOutput = enabled
+	return c
+}
+
+// EchoCommands - Sets whether RunBatch and Replay write each line to stderr,
+// prefixed with "+ ", before running it, like 'set -x'. It is off by default.
+func (c *Cli) EchoCommands(enabled bool) *Cli {
+	c.echoCommands = enabled
+	return c
+}
+
+// BufferOutput - Sets whether the output of actions is buffered, and written
+// when they return, to reduce the writes of many small prints. Actions call
+// Flush to write earlier, e.g. before prompting.
+func (c *Cli) BufferOutput(enabled bool) *Cli {
+	c.bufferOutput = enabled
+	return c
+}
+
+// StdoutWrapper - Sets the function wrapping Stdout(ctx) for actions, also when
+// run by RunBuffer, e.g. to redact secrets or compress the output. A wrapper
+// that is an io.Closer, such as a gzip.Writer, is closed when the action returns.
+func (c *Cli) StdoutWrapper(wrap func(io.Writer) io.Writer) *Cli {
+	c.stdoutWrapper = wrap
+	return c
+}
+
+// OutputTransform - Sets the function applied to the output captured by
+// RunBuffer, and so RunLine and RunUnmarshal, before returning it.
+func (c *Cli) OutputTransform(fn func(string) string) *Cli {
+	c.outputTransform = fn
+	return c
+}
+
+// MessageTranslator - Sets the function producing the user-facing messages, such
+// as help headers and error prefixes, from the message key (one of the Msg*
+// constants) and its arguments. By default the keys are formatted as in English.
+func (c *Cli) MessageTranslator(fn func(key string, args ...interface{}) string) *Cli {
+	c.translator = fn
+	return c
+}
+
+// message returns the message for key with args.
+func (c *Cli) message(key string, args ...interface{}) string {
+	if c.translator != nil {
+		return c.translator(key, args...)
+	}
+	return fmt.Sprintf(key, args...)
+}
+
+// ErrorTransform - Sets the function applied to the non-nil errors returned by
+// Run, e.g. to map internal errors to API-friendly ones.
+func (c *Cli) ErrorTransform(fn func(error) error) *Cli {
+	c.errorTransform = fn
+	return c
+}
+
+// TransactionWrapper - Sets the function beginning a transaction around each
+// action. It returns the context for the action and a function called with the
+// error of the action, which commits or rolls back accordingly and returns the
+// final error. Commands opt out with NoTransaction.
+func (c *Cli) TransactionWrapper(begin func(context.Context) (context.Context, func(error) error, error)) *Cli {
+	c.beginTransaction = begin
+	return c
+}
+
 // HelpHandler - Sets the help handler
 func (c *Cli) HelpHandler(handler func(context.Context, *Cli) error) *Cli {
 	c.helpHandler = handler
@@ -173,7 +678,14 @@ func (cli *Cli) RunBuffer(ctx context.Context, printsJson bool, args ...string)
 	buf := new(bytes.Buffer)
 	ctx = WithStdout(ctx, buf)
 	err := cli.Run(ctx, args...)
-	return buf.Bytes(), err
+	out := buf.Bytes()
+	if cli.trimOutput {
+		out = bytes.TrimSpace(out) // whitespace around JSON is insignificant
+	}
+	if cli.outputTransform != nil {
+		return []byte(cli.outputTransform(string(out))), err
+	}
+	return out, err
 }
 
 func (cli *Cli) RunLine(ctx context.Context, printsJson bool, line string) ([]byte, error) {
@@ -181,10 +693,193 @@ func (cli *Cli) RunLine(ctx context.Context, printsJson bool, line string) ([]by
 	return cli.RunBuffer(ctx, printsJson, words...)
 }
 
+// RunLineSeq runs the commands in line separated by unquoted semicolons, such as
+// "set x=1 ; show x", with RunBuffer, returning their outputs. It stops at the
+// first error, returning the outputs so far. Single or double quotes group
+// words and protect semicolons, and are removed.
+func (cli *Cli) RunLineSeq(ctx context.Context, printsJson bool, line string) ([][]byte, error) {
+	cmds, err := splitCommands(line)
+	if err != nil {
+		return nil, err
+	}
+
+	var outs [][]byte
+	for _, words := range cmds {
+		out, err := cli.RunBuffer(ctx, printsJson, words...)
+		outs = append(outs, out)
+		if err != nil {
+			return outs, err
+		}
+	}
+	return outs, nil
+}
+
+// splitCommands splits line into the words of the commands separated by
+// unquoted semicolons, skipping empty commands.
+func splitCommands(line string) ([][]string, error) {
+	var cmds [][]string
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+
+	endWord := func() {
+		if inWord {
+			words = append(words, word.String())
+			word.Reset()
+			inWord = false
+		}
+	}
+	endCommand := func() {
+		endWord()
+		if len(words) > 0 {
+			cmds = append(cmds, words)
+			words = nil
+		}
+	}
+
+	for _, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inWord = true
+		case r == ';':
+			endCommand()
+		case unicode.IsSpace(r):
+			endWord()
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("Unterminated quote %c in '%s'", quote, line)
+	}
+	endCommand()
+	return cmds, nil
+}
+
+// BatchResult is the result of a line run by RunBatch.
+type BatchResult struct {
+	Line   string
+	Output []byte
+	Err    error
+}
+
+// RunBatch runs the lines with RunLine, skipping blank ones, and returns their
+// results and the first error. With stopOnError, it stops at the first error,
+// returning the results so far.
+func (cli *Cli) RunBatch(ctx context.Context, lines []string, stopOnError bool) ([]BatchResult, error) {
+	var results []BatchResult
+	var firstErr error
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		cli.echo(ctx, line)
+		out, err := cli.RunLine(ctx, PrintsJson(ctx), line)
+		results = append(results, BatchResult{line, out, err})
+		if err != nil && firstErr == nil {
+			firstErr = err
+			if stopOnError {
+				break
+			}
+		}
+	}
+	return results, firstErr
+}
+
+// Replay runs the lines of the file at path, such as recorded by the RecordPath
+// of RunLoopConfig, with RunLine, writing their outputs to Stdout(ctx). Blank
+// lines are skipped, and it stops at the first error.
+func (cli *Cli) Replay(ctx context.Context, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		cli.echo(ctx, line)
+		out, err := cli.RunLine(ctx, PrintsJson(ctx), line)
+		if _, werr := Stdout(ctx).Write(out); werr != nil && err == nil {
+			err = werr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// echo writes line to Stderr(ctx) if EchoCommands is set.
+func (cli *Cli) echo(ctx context.Context, line string) {
+	if cli.echoCommands {
+		fmt.Fprintln(Stderr(ctx), "+ "+line)
+	}
+}
+
+// RunJSON runs the command at the space-separated path cmd with flags given as
+// the fields of the JSON object payload, returning the output. Fields must match
+// the flags of the command, in name and type.
+func (cli *Cli) RunJSON(ctx context.Context, cmd string, payload json.RawMessage) (string, error) {
+	path := strings.Fields(cmd)
+	command := cli.rootCommand.findCommand(path)
+	if command == nil {
+		return "", fmt.Errorf("Unknown command '%s'", cmd)
+	}
+
+	var fields map[string]interface{}
+	if len(payload) > 0 {
+		dec := json.NewDecoder(bytes.NewReader(payload))
+		dec.UseNumber()
+		if err := dec.Decode(&fields); err != nil {
+			return "", fmt.Errorf("Invalid JSON payload: %w", err)
+		}
+	}
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	args := path
+	for _, name := range names {
+		proto := command.flags.protos[name]
+		if proto == nil {
+			proto = cli.persistentFlags.protos[name]
+		}
+		if proto == nil {
+			return "", fmt.Errorf("Unknown field '%s' for command '%s'", name, cmd)
+		}
+		val, err := proto.format(fields[name])
+		if err != nil {
+			return "", err
+		}
+		args = append(args, "--"+name+"="+val)
+	}
+
+	buf, err := cli.RunBuffer(ctx, PrintsJson(ctx), args...)
+	return string(buf), err
+}
+
 func (cli *Cli) RunUnmarshal(ctx context.Context, line string, ret interface{}) error {
 	buf, err := cli.RunLine(ctx, true, line)
 	if err == nil {
-		err = json.Unmarshal(buf, ret)
+		if err = json.Unmarshal(buf, ret); err != nil {
+			if len(buf) > 64 {
+				buf = append(buf[:61:61], "..."...)
+			}
+			err = fmt.Errorf("Invalid JSON output of '%s': %w: %q", line, err, buf)
+		}
 	}
 	return err
 }
@@ -27,9 +27,17 @@
 package jcli
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const (
@@ -48,6 +56,41 @@ type Command struct {
 	actionCallback   Action
 	hidden           bool
 	flags            *flagSet
+
+	examples          []example
+	noTransaction     bool
+	timeout           time.Duration
+	flagCompletions   map[string]func(context.Context, string) []string
+	noFlagParsing     bool     // whether args are all positional
+	external          bool     // whether running an external executable
+	catchAll          *Command // run when no subcommand matches
+	defaultSubCommand *Command // run when no subcommand given
+	forwardToDefault  bool     // whether unmatched args go to defaultSubCommand
+	envPrefix         string   // prefix of environment variables for unset flags
+	argsUsage         string   // usage of the positional arguments
+	renamedFrom       []string // deprecated names still accepted
+	viperSection      string   // viper section of flag defaults
+	errorHandler      func(string, error) error
+	namedArgs         []namedArg // names of the leading positional arguments
+	meta              map[string]string
+	normalizers       map[string]func(string) string
+	semaphore         chan struct{} // limits concurrent runs of the action
+	failFast          bool          // whether to fail rather than wait at the limit
+	flagGroups        []*FlagGroup
+	viperNamespace    string
+	tags              []string // tags selecting the preflight checks
+}
+
+// namedArg is a positional argument retrieved by name with StringArg
+type namedArg struct {
+	name         string
+	defaultValue string
+}
+
+// example is an example invocation shown in help
+type example struct {
+	command     string
+	explanation string
 }
 
 // NewCommand creates a new Command
@@ -62,6 +105,37 @@ func NewCommand(name string, description string) *Command {
 	return result
 }
 
+// FromFlagSet creates a new Command with the flags of fs, with their names,
+// usages and defaults, running action. Only string, int, float64 and bool flags
+// are imported; others are ignored. Values are parsed into fresh storage, not
+// the variables bound to fs.
+func FromFlagSet(name, description string, fs *flag.FlagSet, action Action) *Command {
+	c := NewCommand(name, description).Action(action)
+	fs.VisitAll(func(f *flag.Flag) {
+		getter, ok := f.Value.(flag.Getter)
+		if !ok {
+			return
+		}
+		switch getter.Get().(type) {
+		case string:
+			c.StringFlag(f.Name, f.Usage, f.DefValue)
+		case int:
+			if v, err := strconv.Atoi(f.DefValue); err == nil {
+				c.IntFlag(f.Name, f.Usage, v)
+			}
+		case float64:
+			if v, err := strconv.ParseFloat(f.DefValue, 64); err == nil {
+				c.FloatFlag(f.Name, f.Usage, v)
+			}
+		case bool:
+			if v, err := strconv.ParseBool(f.DefValue); err == nil {
+				c.BoolFlag(f.Name, f.Usage, v)
+			}
+		}
+	})
+	return c
+}
+
 func (c *Command) commandPath() string {
 	pth := c.name
 	for i := maxDepth; i > 0 && c.parent != nil; i-- {
@@ -73,14 +147,30 @@ func (c *Command) commandPath() string {
 	return pth
 }
 
-func (c *Command) longestSubcommand() int {
-	var longest int
-	for _, subcommand := range c.subCommands {
-		if n := len(subcommand.name); n > longest {
-			longest = n
+// resolvePath returns the space-separated names of the subcommands the leading
+// args lead to from c.
+func (c *Command) resolvePath(args []string) string {
+	var names []string
+	for _, arg := range args {
+		sub := c.subCommandsMap[arg]
+		if sub == nil || len(names) >= maxDepth {
+			break
+		}
+		names = append(names, sub.name)
+		c = sub
+	}
+	return strings.Join(names, " ")
+}
+
+// findCommand returns the command reached by following the subcommand names in
+// path, or nil if there is none.
+func (c *Command) findCommand(path []string) *Command {
+	for _, name := range path {
+		if c = c.subCommandsMap[name]; c == nil {
+			return nil
 		}
 	}
-	return longest
+	return c
 }
 
 func (c *Command) getCli() *Cli {
@@ -93,31 +183,101 @@ func (c *Command) getCli() *Cli {
 	return nil
 }
 
-// Run - Runs the Command with the given arguments
-func (c *Command) run(ctx context.Context, args []string) error {
+// Run - Runs the Command with the given arguments, at the given depth of
+// dispatching from the root command
+func (c *Command) run(ctx context.Context, args []string, depth int) error {
 	app := c.getCli()
 	if app == nil {
 		return fmt.Errorf("Command not setup correctly")
 	}
+	if depth > maxDepth {
+		return ErrRecursionLimit
+	}
 
-	var err error
-
-	// If we have arguments, process them
+	// If we have arguments, check for subcommands first
 	if len(args) > 0 {
 		// Check for subcommand
 		subcommand := c.subCommandsMap[args[0]]
 		if subcommand != nil {
-			return subcommand.run(ctx, args[1:])
+			if args[0] != subcommand.name {
+				fmt.Fprintln(Stderr(ctx), c.message(MsgDeprecatedName, args[0], subcommand.name))
+			}
+			return subcommand.run(ctx, args[1:], depth+1)
 		}
 
-		// Parse flags
-		commandPath := c.commandPath()
-		ctx, err = c.flags.parseFlags(ctx, commandPath, args)
+		// Or hand unmatched arguments to the catch-all command
+		if c.catchAll != nil && !strings.HasPrefix(args[0], "-") {
+			return c.catchAll.run(ctx, args, depth+1)
+		}
+
+		// Forward unmatched arguments to the default subcommand
+		if c.defaultSubCommand != nil && c.forwardToDefault && !strings.HasPrefix(args[0], "-") {
+			return c.defaultSubCommand.run(ctx, args, depth+1)
+		}
+
+		// Or hand flags without a command to the default command, as the root
+		// has no action to use them, if they are its flags; root flags are
+		// parsed below instead. Help is still that of the root
+		if c == app.rootCommand && c.actionCallback == nil && app.defaultCommand != nil &&
+			app.defaultCommand != c && strings.HasPrefix(args[0], "-") && !isHelpArg(args[0]) &&
+			app.defaultCommand.flags.definesFlags(args, app.persistentFlags) {
+			return app.defaultCommand.run(ctx, args, depth+1)
+		}
+	}
+
+	// Keep the arguments as given, for RawArgs
+	ctx = context.WithValue(ctx, RawArgsKey, args)
+
+	// Parse flags, after expanding presets, unless taken as is. Without
+	// arguments, flags are only parsed for fallbacks such as EnvPrefix to apply,
+	// leaving the defaults of flags unset otherwise.
+	commandPath := c.commandPath()
+	if c.noFlagParsing {
+		ctx = withArgs(ctx, commandPath, args)
+	} else if len(args) > 0 || c.hasFlagFallbacks(ctx) {
+		parsed, err := app.expandArgs(args, c.flags)
+		if err == nil && app.verbosityFlag {
+			parsed = c.flags.expandCounts(parsed, app.persistentFlags)
+		}
+		if err == nil && app.explicitBools {
+			parsed = c.flags.joinBoolValues(parsed, app.persistentFlags)
+		}
+		if err == nil {
+			ctx, err = c.flags.parseFlags(ctx, commandPath, parsed, app.persistentFlags)
+		}
+		// Seeds apply to the command running its action, not the ones
+		// dispatching to it, such as the root to the default command
+		if seeds, ok := ctx.Value(SeedFlagsKey).(map[string]interface{}); ok && err == nil && c.actionCallback != nil {
+			for name := range seeds {
+				if c.flags.lookup(name, app.persistentFlags) == nil {
+					err = fmt.Errorf("Unknown flag '%s' for command '%s'", name, commandPath)
+				}
+			}
+			if err == nil {
+				err = getFlagValues(ctx).applyMap(seeds, FlagSourceProgram)
+			}
+			ctx = context.WithValue(ctx, SeedFlagsKey, nil) // not for nested runs
+		}
+		if err == nil && c.envPrefix != "" {
+			err = getFlagValues(ctx).applyEnv(c.envPrefix)
+		}
+		if err == nil && c.viperSection != "" {
+			err = getFlagValues(ctx).applyMap(GetStringMap(ctx, c.viperSection), FlagSourceViper)
+		}
+		if err == nil && app.flagTemplates {
+			err = getFlagValues(ctx).renderTemplates()
+		}
+		if err == nil {
+			c.normalizeFlags(ctx)
+		}
 		if err != nil {
+			if c.errorHandler != nil {
+				return c.errorHandler(commandPath, err)
+			}
 			if app.errorHandler != nil {
-				return app.errorHandler(c.commandPath(), err)
+				return app.errorHandler(commandPath, err)
 			}
-			return fmt.Errorf("Error: %s\nSee '%s --help' for usage", err, commandPath)
+			return errors.New(app.message(MsgUsageError, err, commandPath))
 		}
 
 		// Help takes precedence
@@ -125,11 +285,51 @@ func (c *Command) run(ctx context.Context, args []string) error {
 			c.PrintHelp(ctx)
 			return nil
 		}
+
+		if app.explainFlags && BoolFlag(ctx, "explain-flags", false) {
+			return explainFlags(ctx)
+		}
 	}
 
 	// Do we have an action?
 	if c.actionCallback != nil {
-		return c.actionCallback(ctx)
+		if len(c.namedArgs) > 0 {
+			ctx = context.WithValue(ctx, NamedArgsKey, c.bindArgs(OtherArgs(ctx)))
+		}
+		if c.viperNamespace != "" {
+			ctx = context.WithValue(ctx, ViperNamespaceKey, c.viperNamespace)
+		}
+		if err := c.preflight(ctx, app); err != nil {
+			return err
+		}
+		if c.semaphore != nil {
+			if err := c.acquire(ctx); err != nil {
+				return err
+			}
+			defer func() { <-c.semaphore }()
+		}
+		if app.metrics != nil {
+			defer func(start time.Time) {
+				app.metrics.record(c.commandPath(), time.Since(start))
+			}(time.Now())
+		}
+		return c.runAction(ctx, app)
+	}
+
+	// An empty command is a misconfiguration rather than a request for help
+	if c.isEmpty() {
+		return fmt.Errorf("%w: command '%s'", ErrNoAction, c.commandPath())
+	}
+
+	// Or the command for piped input, if no command is given?
+	if c == app.rootCommand && len(args) == 0 && app.stdinCommand != nil &&
+		app.stdinCommand != c && StdinIsPipe(ctx) {
+		return app.stdinCommand.run(ctx, args, depth+1)
+	}
+
+	// Or a default subcommand?
+	if c.defaultSubCommand != nil && len(args) == 0 {
+		return c.defaultSubCommand.run(ctx, args, depth+1)
 	}
 
 	// If we haven't specified a subcommand
@@ -139,7 +339,11 @@ func (c *Command) run(ctx context.Context, args []string) error {
 		if app.defaultCommand != c {
 			// only run default command if no args passed
 			if len(args) == 0 {
-				return app.defaultCommand.run(ctx, args)
+				return app.defaultCommand.run(ctx, args, depth+1)
+			}
+			// or only root flags, with their values in ctx
+			if c == app.rootCommand && !c.noFlagParsing && len(OtherArgs(ctx)) == 0 {
+				return app.defaultCommand.run(ctx, nil, depth+1)
 			}
 		}
 	}
@@ -153,12 +357,178 @@ func (c *Command) run(ctx context.Context, args []string) error {
 	return ErrHelp
 }
 
+// hasFlagFallbacks returns whether flags not given may take values other than
+// their defaults, from the environment, viper or, for commands with an action,
+// RunWithFlags.
+func (c *Command) hasFlagFallbacks(ctx context.Context) bool {
+	_, seeded := ctx.Value(SeedFlagsKey).(map[string]interface{})
+	return c.envPrefix != "" || c.viperSection != "" || seeded && c.actionCallback != nil
+}
+
+// isHelpArg returns whether arg is the help flag.
+func isHelpArg(arg string) bool {
+	name, _, ok := flagName(arg)
+	return ok && name == "help"
+}
+
+// runAction runs the action of the command with the per-run settings of app
+// applied around it.
+func (c *Command) runAction(ctx context.Context, app *Cli) (err error) {
+	helpCtx := ctx // for ErrShowHelp, with the output not redirected
+
+	// Run the functions given to Defer last
+	stack := &deferStack{}
+	ctx = context.WithValue(ctx, DeferKey, stack)
+	defer func() {
+		err = stack.run(err)
+	}()
+
+	if app.outputFileFlag {
+		if path := c.persistentString(ctx, "output", "o"); path != "" {
+			f, ferr := os.Create(path)
+			if ferr != nil {
+				return ferr
+			}
+			ctx = WithStdout(ctx, f)
+			defer func() {
+				err = joinErrors(err, f.Close())
+			}()
+		}
+	}
+
+	if app.stdoutWrapper != nil {
+		out := Stdout(ctx)
+		w := app.stdoutWrapper(out)
+		ctx = WithStdout(ctx, w)
+		if closer, ok := w.(io.Closer); ok && w != out {
+			defer func() {
+				err = joinErrors(err, closer.Close())
+			}()
+		}
+	}
+
+	if app.bufferOutput {
+		w := bufio.NewWriter(Stdout(ctx))
+		ctx = WithStdout(ctx, w)
+		defer func() {
+			err = joinErrors(err, w.Flush())
+		}()
+	}
+
+	if app.chdirFlag {
+		if dir := c.persistentString(ctx, "chdir", "C"); dir != "" {
+			restore, cerr := chdir(dir)
+			if cerr != nil {
+				return cerr
+			}
+			defer func() {
+				if rerr := restore(); err == nil {
+					err = rerr
+				}
+			}()
+		}
+	}
+
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	if app.beginTransaction != nil && !c.noTransaction {
+		txCtx, finish, err := app.beginTransaction(ctx)
+		if err != nil {
+			return err
+		}
+		return finish(c.showHelp(helpCtx, c.actionCallback(txCtx)))
+	}
+
+	return c.showHelp(helpCtx, c.actionCallback(ctx))
+}
+
+// showHelp prints the help of the command if err, as returned by its action, is
+// ErrShowHelp, which is then not an error.
+func (c *Command) showHelp(ctx context.Context, err error) error {
+	if errors.Is(err, ErrShowHelp) {
+		c.PrintHelp(ctx)
+		return nil
+	}
+	return err
+}
+
+// persistentString returns the first non-empty value of the persistent string
+// flags named names, skipping the flags the command defines itself, which take
+// their place when parsing.
+func (c *Command) persistentString(ctx context.Context, names ...string) string {
+	for _, name := range names {
+		if _, own := c.flags.protos[name]; own {
+			continue
+		}
+		if val := StringFlag(ctx, name, ""); val != "" {
+			return val
+		}
+	}
+	return ""
+}
+
+// chdir changes the working directory to dir and returns a function restoring
+// the previous one.
+func chdir(dir string) (func() error, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chdir(dir); err != nil {
+		return nil, fmt.Errorf("Cannot change to directory '%s': %w", dir, err)
+	}
+	return func() error {
+		return os.Chdir(wd)
+	}, nil
+}
+
+// validate checks the names of the flags and the subcommands of c, recursively.
+func (c *Command) validate(app *Cli, depth int) error {
+	if depth <= 0 {
+		return nil
+	}
+	for name := range c.flags.protos {
+		if reservedNames[name] {
+			return fmt.Errorf("%w: flag '%s' of '%s'", ErrReservedName, name, c.commandPath())
+		}
+	}
+	for _, subcommand := range c.subCommands {
+		if reservedNames[subcommand.name] && !app.allowedNames[subcommand.name] {
+			return fmt.Errorf("%w: command '%s'", ErrReservedName, subcommand.commandPath())
+		}
+		if err := subcommand.validate(app, depth-1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isEmpty returns whether c is a command other than the root and the default
+// command with nothing to run, neither an action nor subcommands.
+func (c *Command) isEmpty() bool {
+	if c.parent == nil || c.actionCallback != nil || len(c.subCommands) > 0 || c.catchAll != nil {
+		return false
+	}
+	app := c.getCli()
+	return app == nil || app.defaultCommand != c
+}
+
 // Action - Define an action from this command
 func (c *Command) Action(callback Action) *Command {
 	c.actionCallback = callback
 	return c
 }
 
+// ActionFunc - Returns the action of the command, or nil if none, e.g. to call
+// it directly in tests or compose it into other actions
+func (c *Command) ActionFunc() Action {
+	return c.actionCallback
+}
+
 // Command - Adds subcommands to this command
 func (c *Command) SubCommands(commands ...*Command) *Command {
 	for _, command := range commands {
@@ -170,6 +540,13 @@ func (c *Command) SubCommands(commands ...*Command) *Command {
 // PrintHelp - Output the help text for this command
 func (c *Command) PrintHelp(ctx context.Context) {
 	app := c.getCli()
+	out := Stdout(ctx)
+	if app != nil && app.helpTemplate != nil {
+		if err := app.helpTemplate.Execute(out, c.HelpData()); err != nil {
+			fmt.Fprintln(Stderr(ctx), err)
+		}
+		return
+	}
 	if app != nil {
 		app.PrintBanner(ctx)
 	}
@@ -181,36 +558,104 @@ func (c *Command) PrintHelp(ctx context.Context) {
 	}
 	// Ignore root command
 	if commandPath != c.name {
-		fmt.Println(commandTitle)
+		fmt.Fprintln(out, commandTitle)
 	}
 	if c.longdescription != "" {
-		fmt.Println(c.longdescription + "\n")
+		fmt.Fprintln(out, c.longdescription+"\n")
 	}
-	if len(c.subCommands) > 0 {
-		fmt.Println("Available commands:")
-		fmt.Println("")
-		longest := c.longestSubcommand()
-		for _, subcommand := range c.subCommands {
-			if subcommand.isHidden() {
-				continue
+	if commands := c.HelpData().Commands; len(commands) > 0 {
+		fmt.Fprintln(out, c.message(MsgAvailableCommands))
+		fmt.Fprintln(out, "")
+		longest := longestName(commands)
+		verbose := Verbosity(ctx) > 0 || (app != nil && app.verboseHelp)
+		for _, subcommand := range commands {
+			spacer := strings.Repeat(" ", 3+longest-len(subcommand.Name))
+			marker := ""
+			if subcommand.Default {
+				marker = c.message(MsgDefault)
+			} else if subcommand.External {
+				marker = c.message(MsgExternal)
 			}
-			spacer := strings.Repeat(" ", 3+longest-len(subcommand.name))
-			isDefault := ""
-			if subcommand.isDefaultCommand() {
-				isDefault = "[default]"
+			fmt.Fprintf(out, "   %s%s%s %s\n", subcommand.Name, spacer, subcommand.Description, marker)
+			if verbose && subcommand.LongDescription != "" {
+				indent := strings.Repeat(" ", 6+longest)
+				for _, line := range strings.Split(strings.TrimSpace(subcommand.LongDescription), "\n") {
+					fmt.Fprintln(out, strings.TrimRight(indent+line, " "))
+				}
 			}
-			fmt.Printf("   %s%s%s %s\n", subcommand.name, spacer, subcommand.shortdescription, isDefault)
 		}
-		fmt.Println("")
+		fmt.Fprintln(out, "")
+	}
+	if len(c.examples) > 0 {
+		fmt.Fprintln(out, c.message(MsgExamples))
+		fmt.Fprintln(out, "")
+		for _, example := range c.examples {
+			fmt.Fprintf(out, "   %s\n", example.command)
+			if example.explanation != "" {
+				fmt.Fprintf(out, "      %s\n", example.explanation)
+			}
+		}
+		fmt.Fprintln(out, "")
 	}
 	if c.flags.flagCount() > 0 {
-		c.flags.printDefaults(ctx)
+		var persistent *flagSet
+		if app != nil {
+			persistent = app.persistentFlags
+		}
+		skip := make(map[string]bool)
+		for _, group := range c.flagGroups {
+			for name := range group.flags.protos {
+				skip[name] = true
+			}
+		}
+		c.flags.printDefaults(ctx, c.message(MsgFlags), commandPath, persistent, skip)
+		for _, group := range c.flagGroups {
+			fmt.Fprintln(out)
+			group.flags.printDefaults(ctx, c.message(MsgGroupFlags, group.name), commandPath, nil, map[string]bool{"help": true})
+		}
+	}
+	fmt.Fprintln(out)
+}
+
+// HelpString - Returns the help text for this command as PrintHelp outputs it
+func (c *Command) HelpString(ctx context.Context) string {
+	buf := new(bytes.Buffer)
+	c.PrintHelp(WithStdout(ctx, buf))
+	return buf.String()
+}
+
+// Run - Runs the command directly with the given arguments, bypassing the root
+// dispatcher and the pre-run of the application, which the command must be
+// attached to
+func (c *Command) Run(ctx context.Context, args ...string) error {
+	app := c.getCli()
+	if app == nil {
+		return fmt.Errorf("Command '%s' is not attached to a Cli", c.name)
+	}
+	return c.run(context.WithValue(ctx, CliKey, app), args, 0)
+}
+
+// RunString - Runs the command like Run, returning its output
+func (c *Command) RunString(ctx context.Context, args ...string) (string, error) {
+	buf := new(bytes.Buffer)
+	err := c.Run(WithStdout(ctx, buf), args...)
+	return buf.String(), err
+}
+
+// message returns the message for key translated by the application, if any.
+func (c *Command) message(key string, args ...interface{}) string {
+	if app := c.getCli(); app != nil {
+		return app.message(key, args...)
 	}
-	fmt.Fprintln(Stdout(ctx))
+	return fmt.Sprintf(key, args...)
 }
 
-// isDefaultCommand returns true if called on the default command
+// isDefaultCommand returns true if called on the default command, or the
+// default subcommand of its parent
 func (c *Command) isDefaultCommand() bool {
+	if c.parent != nil && c.parent.defaultSubCommand == c {
+		return true
+	}
 	app := c.getCli()
 	return app != nil && app.defaultCommand == c
 }
@@ -242,6 +687,24 @@ func (c *Command) AddCommand(command *Command) {
 	name := command.name
 	c.subCommands = append(c.subCommands, command)
 	c.subCommandsMap[name] = command
+	for _, oldName := range command.renamedFrom {
+		if _, ok := c.subCommandsMap[oldName]; !ok {
+			c.subCommandsMap[oldName] = command
+		}
+	}
+}
+
+// RenamedFrom - Keeps accepting the old name of the command, printing a
+// deprecation warning to stderr when invoked by it. The old name is hidden
+// from help and never shadows another command.
+func (c *Command) RenamedFrom(oldName string) *Command {
+	c.renamedFrom = append(c.renamedFrom, oldName)
+	if c.parent != nil {
+		if _, ok := c.parent.subCommandsMap[oldName]; !ok {
+			c.parent.subCommandsMap[oldName] = c
+		}
+	}
+	return c
 }
 
 // BoolFlag - Adds a boolean flag to the command. Use the first pointer in ptrs, if given,
@@ -285,6 +748,251 @@ func (c *Command) FloatFlag(name, description string, val float64, ptrs ...*floa
 	return c
 }
 
+// ByteSizeFlag - Adds a flag of a number of bytes to the command, given with an
+// optional unit: KB, MB, GB and TB for powers of 1000, or KiB, MiB, GiB and TiB
+// for powers of 1024
+func (c *Command) ByteSizeFlag(name, description string, val int64) *Command {
+	c.flags.addFlag(name, description, byteSize(val), nil)
+	return c
+}
+
+// CatchAll - Sets the command run when the first argument is neither a
+// subcommand nor a flag, with all arguments, including the first one
+func (c *Command) CatchAll(command *Command) *Command {
+	command.parent = c
+	c.catchAll = command
+	return c
+}
+
+// DefaultSubCommand - Sets the subcommand to run when no subcommand is given,
+// adding it to the command if not added yet
+func (c *Command) DefaultSubCommand(subcommand *Command) *Command {
+	if subcommand.parent != c {
+		c.AddCommand(subcommand)
+	}
+	c.defaultSubCommand = subcommand
+	return c
+}
+
+// DefaultSubCommandForwarding - Sets whether arguments not matching a subcommand,
+// such as `foo` in `remote foo`, are forwarded to the default subcommand. Arguments
+// starting with a flag are still parsed by the command itself.
+func (c *Command) DefaultSubCommandForwarding(enabled bool) *Command {
+	c.forwardToDefault = enabled
+	return c
+}
+
+// AddFlagGroup - Adds the flags of the group to the command, listed in their
+// own section in help
+func (c *Command) AddFlagGroup(group *FlagGroup) *Command {
+	for _, proto := range group.flags.protos {
+		c.flags.addFlag(proto.name, proto.description, proto.value, nil)
+	}
+	c.flagGroups = append(c.flagGroups, group)
+	return c
+}
+
+// Timeout - Sets the deadline of the context given to the action, from the time
+// it starts; zero for none
+func (c *Command) Timeout(d time.Duration) *Command {
+	c.timeout = d
+	return c
+}
+
+// EnvPrefix - Falls back to the environment variable PREFIX_NAME for every flag
+// of the command not given on the command line, where NAME is the flag name in
+// upper case with dashes turned into underscores. The command line still takes
+// precedence, and the static default applies when neither is set.
+func (c *Command) EnvPrefix(prefix string) *Command {
+	c.envPrefix = prefix
+	return c
+}
+
+// ViperNamespace - Prefixes the viper keys read by the XxxOrViper helpers in
+// the action with prefix and a dot, so that commands read their own sections
+func (c *Command) ViperNamespace(prefix string) *Command {
+	c.viperNamespace = prefix
+	return c
+}
+
+// NormalizeFlag - Applies fn to the value of the string flag after parsing,
+// whatever its source, such as to trim or lower-case it
+func (c *Command) NormalizeFlag(name string, fn func(string) string) *Command {
+	if c.normalizers == nil {
+		c.normalizers = make(map[string]func(string) string)
+	}
+	c.normalizers[name] = fn
+	return c
+}
+
+// normalizeFlags applies the functions given to NormalizeFlag to the parsed
+// values in ctx.
+func (c *Command) normalizeFlags(ctx context.Context) {
+	for name, fn := range c.normalizers {
+		if ptr, ok := getValuePointer(ctx, name); ok {
+			if val, ok := ptr.(*string); ok {
+				*val = fn(*val)
+			}
+		}
+	}
+}
+
+// FlagsFromViperSection - Takes the entries of the section of the viper in the
+// context as the defaults of the matching flags, after the command line and
+// EnvPrefix but before the static defaults
+func (c *Command) FlagsFromViperSection(section string) *Command {
+	c.viperSection = section
+	return c
+}
+
+// ErrorFunction - Sets the custom error for flag errors of this command, taking
+// precedence over the one set by Cli.ErrorFunction
+func (c *Command) ErrorFunction(fn func(string, error) error) *Command {
+	c.errorHandler = fn
+	return c
+}
+
+// MaxConcurrency - Limits the number of concurrent runs of the action to n,
+// with further runs waiting for a slot, or failing with ErrConcurrencyLimit if
+// failFast; zero for no limit
+func (c *Command) MaxConcurrency(n int, failFast bool) *Command {
+	c.semaphore = nil
+	if n > 0 {
+		c.semaphore = make(chan struct{}, n)
+	}
+	c.failFast = failFast
+	return c
+}
+
+// acquire takes a slot of the semaphore, waiting unless failFast, or until ctx
+// is done.
+func (c *Command) acquire(ctx context.Context) error {
+	if c.failFast {
+		select {
+		case c.semaphore <- struct{}{}:
+			return nil
+		default:
+			return fmt.Errorf("%w: command '%s'", ErrConcurrencyLimit, c.commandPath())
+		}
+	}
+	select {
+	case c.semaphore <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// DisableHelpFlag - Leaves out the help flag of the command, so that --help and
+// what follows are passed on as positional arguments, e.g. to an external tool
+func (c *Command) DisableHelpFlag() *Command {
+	c.flags.noHelp = true
+	return c
+}
+
+// NoTransaction - Runs the action of the command outside of the transaction
+// set up by Cli.TransactionWrapper
+func (c *Command) NoTransaction() *Command {
+	c.noTransaction = true
+	return c
+}
+
+// Example - Adds an example invocation with its explanation, shown in help in
+// the order added
+func (c *Command) Example(command, explanation string) *Command {
+	c.examples = append(c.examples, example{command, explanation})
+	return c
+}
+
+// ArgsUsage - Describes the positional arguments of the command for its
+// synopsis, such as "<file>..."
+func (c *Command) ArgsUsage(usage string) *Command {
+	c.argsUsage = usage
+	return c
+}
+
+// Arg - Names the next positional argument of the command, retrieved with
+// StringArg and taking the default value if not given
+func (c *Command) Arg(name, defaultValue string) *Command {
+	c.namedArgs = append(c.namedArgs, namedArg{name, defaultValue})
+	return c
+}
+
+// bindArgs maps the names of the positional arguments to the given values or
+// their defaults.
+func (c *Command) bindArgs(args []string) map[string]string {
+	ret := make(map[string]string, len(c.namedArgs))
+	for i, arg := range c.namedArgs {
+		if i < len(args) {
+			ret[arg.name] = args[i]
+		} else {
+			ret[arg.name] = arg.defaultValue
+		}
+	}
+	return ret
+}
+
+// SetMeta - Sets metadata of the command for tooling, such as its owner or
+// stability, which shows in DescribeJSON
+func (c *Command) SetMeta(key, value string) *Command {
+	if c.meta == nil {
+		c.meta = make(map[string]string)
+	}
+	c.meta[key] = value
+	return c
+}
+
+// Meta - Returns the metadata of the command set by SetMeta
+func (c *Command) Meta(key string) (string, bool) {
+	value, ok := c.meta[key]
+	return value, ok
+}
+
+// Tag - Tags the command, e.g. "needs-network", so the checks given to
+// Cli.PreflightForTag for the tags run before its action
+func (c *Command) Tag(tags ...string) *Command {
+	c.tags = append(c.tags, tags...)
+	return c
+}
+
+// preflight runs the checks of app for the tags of the command, in order,
+// returning the first error
+func (c *Command) preflight(ctx context.Context, app *Cli) error {
+	for _, tag := range c.tags {
+		for _, check := range app.preflights[tag] {
+			if err := check(ctx); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Synopsis - Returns the one-line usage of the command, such as
+// "app remote [flags] <command>"
+func (c *Command) Synopsis() string {
+	var sb strings.Builder
+	sb.WriteString(c.commandPath())
+	flagCount := c.flags.flagCount()
+	if app := c.getCli(); app != nil {
+		flagCount += app.persistentFlags.flagCount()
+	}
+	if flagCount > 0 {
+		sb.WriteString(" [flags]")
+	}
+	if len(c.subCommands) > 0 {
+		sb.WriteString(" <command>")
+	}
+	if c.argsUsage != "" {
+		sb.WriteString(" " + c.argsUsage)
+	} else {
+		for _, arg := range c.namedArgs {
+			sb.WriteString(" [" + arg.name + "=" + arg.defaultValue + "]")
+		}
+	}
+	return sb.String()
+}
+
 // LongDescription - Sets the long description for the command
 func (c *Command) LongDescription(longdescription string) *Command {
 	c.longdescription = longdescription
@@ -0,0 +1,155 @@
+// Copyright (c) 2021 Jing-Ying Chen. Subject to the MIT License.
+
+package jcli
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// FlagNames - Returns the names of the flags registered on the command, sorted
+func (c *Command) FlagNames() []string {
+	names := make([]string, 0, len(c.flags.protos))
+	for name := range c.flags.protos {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// GenSimpleCompletion - Writes the names of the visible top-level commands,
+// separated by spaces, as a word list for bash `complete -W`
+func (cli *Cli) GenSimpleCompletion(ctx context.Context, w io.Writer) error {
+	commands := cli.HelpData().Commands
+	names := make([]string, len(commands))
+	for i, command := range commands {
+		names[i] = command.Name
+	}
+	_, err := fmt.Fprintln(w, strings.Join(names, " "))
+	return err
+}
+
+// CompletionCommand - Adds the hidden `__complete` command for shell completion
+// scripts. Given the words of a partial command line, the last one being the
+// word to complete (possibly empty), it prints the candidates one per line.
+func (cli *Cli) CompletionCommand() *Command {
+	c := cli.NewSubCommand("__complete", "Print completion candidates").
+		Action(func(ctx context.Context) error {
+			var words []string
+			partial := ""
+			if args := OtherArgs(ctx); len(args) > 0 {
+				words, partial = args[:len(args)-1], args[len(args)-1]
+			}
+			for _, candidate := range cli.complete(ctx, words, partial) {
+				if err := Println(ctx, candidate); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	c.Hidden()
+	c.noFlagParsing = true
+	return c
+}
+
+// FlagCompletion - Sets the function providing candidate values of the flag,
+// given the value typed so far; those not starting with it are dropped
+func (c *Command) FlagCompletion(name string, fn func(ctx context.Context, prefix string) []string) *Command {
+	if c.flagCompletions == nil {
+		c.flagCompletions = make(map[string]func(context.Context, string) []string)
+	}
+	c.flagCompletions[name] = fn
+	return c
+}
+
+// completeFlag returns the candidate values of the flag starting with prefix.
+func (c *Command) completeFlag(ctx context.Context, name, prefix string) []string {
+	fn := c.flagCompletions[name]
+	if fn == nil {
+		return nil
+	}
+	var candidates []string
+	for _, candidate := range fn(ctx, prefix) {
+		if strings.HasPrefix(candidate, prefix) {
+			candidates = append(candidates, candidate)
+		}
+	}
+	return candidates
+}
+
+// completeLine returns the completions of line, as full lines, for the REPL.
+func (cli *Cli) completeLine(ctx context.Context, line string) []string {
+	words := strings.Fields(line)
+	partial := ""
+	if len(words) > 0 && !strings.HasSuffix(line, " ") {
+		partial = words[len(words)-1]
+		words = words[:len(words)-1]
+	}
+
+	head := line[:len(line)-len(partial)]
+	candidates := cli.complete(ctx, words, partial)
+	for i, candidate := range candidates {
+		candidates[i] = head + candidate
+	}
+	return candidates
+}
+
+// complete returns the candidates for the partial word following words, which
+// are values of the flag if following one, or flags of the command named by
+// words if partial starts with "-", or its subcommands otherwise.
+func (cli *Cli) complete(ctx context.Context, words []string, partial string) []string {
+	c := cli.rootCommand
+	for _, word := range words {
+		if sub := c.subCommandsMap[word]; sub != nil {
+			c = sub
+		} else if !strings.HasPrefix(word, "-") {
+			break
+		}
+	}
+
+	var candidates []string
+	if len(words) > 0 {
+		if name, hasValue, ok := flagName(words[len(words)-1]); ok && !hasValue && c.flagCompletions[name] != nil {
+			candidates = c.completeFlag(ctx, name, partial)
+			sort.Strings(candidates)
+			return candidates
+		}
+	}
+
+	if name, hasValue, ok := flagName(partial); ok && hasValue {
+		head := partial[:strings.IndexByte(partial, '=')+1]
+		for _, candidate := range c.completeFlag(ctx, name, partial[len(head):]) {
+			candidates = append(candidates, head+candidate)
+		}
+	} else if strings.HasPrefix(partial, "-") {
+		dashes := "-"
+		if strings.HasPrefix(partial, "--") {
+			dashes = "--"
+		}
+		names := c.FlagNames()
+		if !c.flags.noHelp {
+			names = append(names, "help")
+		}
+		for name := range cli.persistentFlags.protos {
+			if _, ok := c.flags.protos[name]; !ok {
+				names = append(names, name)
+			}
+		}
+		for _, name := range names {
+			if strings.HasPrefix(dashes+name, partial) {
+				candidates = append(candidates, dashes+name)
+			}
+		}
+	} else {
+		for _, sub := range c.subCommands {
+			if !sub.isHidden() && strings.HasPrefix(sub.name, partial) {
+				candidates = append(candidates, sub.name)
+			}
+		}
+	}
+	sort.Strings(candidates)
+	return candidates
+}
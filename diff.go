@@ -0,0 +1,98 @@
+// Copyright (c) 2021 Jing-Ying Chen. Subject to the MIT License.
+
+package jcli
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	colorRed   = "\x1b[31m"
+	colorGreen = "\x1b[32m"
+	colorReset = "\x1b[0m"
+)
+
+// UsesColor returns whether output to Stdout(ctx) may be colored: color is
+// enabled by Cli.Color, Stdout(ctx) is a terminal and NO_COLOR is not set.
+func UsesColor(ctx context.Context) bool {
+	cli := GetCli(ctx)
+	return cli != nil && cli.color && IsTerminal(ctx) && os.Getenv("NO_COLOR") == ""
+}
+
+// PrintDiff prints the line-based diff from a to b, with the lines only in a
+// prefixed by "-", those only in b by "+", and common ones by " ". The changed
+// lines are colored if UsesColor.
+func PrintDiff(ctx context.Context, a, b string) error {
+	color := UsesColor(ctx)
+	out := Stdout(ctx)
+	for _, line := range diffLines(splitLines(a), splitLines(b)) {
+		var err error
+		switch {
+		case color && line[0] == '-':
+			_, err = fmt.Fprintln(out, colorRed+line+colorReset)
+		case color && line[0] == '+':
+			_, err = fmt.Fprintln(out, colorGreen+line+colorReset)
+		default:
+			_, err = fmt.Fprintln(out, line)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// diffLines returns the lines of a and b prefixed as in PrintDiff, following
+// their longest common subsequence.
+func diffLines(a, b []string) []string {
+	// lcs[i][j] is the length of the longest common subsequence of a[i:], b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	ret := make([]string, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			ret = append(ret, " "+a[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			ret = append(ret, "-"+a[i])
+			i++
+		default:
+			ret = append(ret, "+"+b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		ret = append(ret, "-"+a[i])
+	}
+	for ; j < len(b); j++ {
+		ret = append(ret, "+"+b[j])
+	}
+	return ret
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2021 Jing-Ying Chen. Subject to the MIT License.
+
+package jcli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	AcceptKey = "__accept__"
+)
+
+// WithAccept returns ctx with the value of an HTTP Accept header, e.g. set by a
+// web bridge, for NegotiateFormat.
+func WithAccept(ctx context.Context, accept string) context.Context {
+	return context.WithValue(ctx, AcceptKey, accept)
+}
+
+// RegisterEncoder - Registers the function encoding values for Emit in the given
+// format, such as "yaml". The "json" format is built in, but can be overridden.
+func (c *Cli) RegisterEncoder(format string, fn func(interface{}) ([]byte, error)) *Cli {
+	if c.encoders == nil {
+		c.encoders = make(map[string]func(interface{}) ([]byte, error))
+	}
+	c.encoders[format] = fn
+	return c
+}
+
+// encoder returns the encoder for format, or nil if unknown.
+func (c *Cli) encoder(format string) func(interface{}) ([]byte, error) {
+	if fn, ok := c.encoders[format]; ok {
+		return fn
+	}
+	if format == "json" {
+		return encodeJson
+	}
+	return nil
+}
+
+func encodeJson(v interface{}) ([]byte, error) {
+	return json.MarshalIndent(v, "", "  ")
+}
+
+// NegotiateFormat - Returns the format with a registered encoder preferred by
+// the Accept header in ctx, if any, or else json. Media types map to formats by
+// their subtypes without any x- prefix, so application/yaml and
+// application/x-yaml are both yaml.
+func (c *Cli) NegotiateFormat(ctx context.Context) string {
+	accept, _ := ctx.Value(AcceptKey).(string)
+	format, best := "json", 0.0
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+		q := 1.0
+		for _, param := range params[1:] {
+			if kv := strings.SplitN(strings.TrimSpace(param), "=", 2); len(kv) == 2 && kv[0] == "q" {
+				if v, err := strconv.ParseFloat(kv[1], 64); err == nil {
+					q = v
+				}
+			}
+		}
+
+		i := strings.IndexByte(mediaType, '/')
+		if i < 0 || q <= best {
+			continue
+		}
+		name := strings.TrimPrefix(mediaType[i+1:], "x-")
+		if name != "*" && c.encoder(name) != nil {
+			format, best = name, q
+		}
+	}
+	return format
+}
+
+// Emit prints v encoded in the format given by the --format flag, or else the
+// one negotiated by NegotiateFormat, using the encoders registered on the
+// running Cli.
+func Emit(ctx context.Context, v interface{}) error {
+	cli := GetCli(ctx)
+	format := StringFlag(ctx, "format", "")
+	if format == "" {
+		if cli != nil {
+			format = cli.NegotiateFormat(ctx)
+		} else {
+			format = "json"
+		}
+	}
+
+	encode := encodeJson
+	if cli != nil {
+		encode = cli.encoder(format)
+	} else if format != "json" {
+		encode = nil
+	}
+	if encode == nil {
+		return fmt.Errorf("Unknown format '%s'", format)
+	}
+
+	buf, err := encode(v)
+	if err != nil {
+		return err
+	}
+	if len(buf) == 0 || buf[len(buf)-1] != '\n' {
+		buf = append(buf, '\n')
+	}
+	_, err = Stdout(ctx).Write(buf)
+	return err
+}
@@ -0,0 +1,54 @@
+// Copyright (c) 2021 Jing-Ying Chen. Subject to the MIT License.
+
+package jcli
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// DiscoverExternalCommands - Adds a command for each executable named with the
+// prefix, such as `myapp-deploy`, found on PATH, git-style. The command, named
+// without the prefix, runs the executable with the remaining arguments. The
+// first executable found for a name wins, and existing commands are kept.
+func (c *Cli) DiscoverExternalCommands(prefix string) *Cli {
+	for _, dir := range filepath.SplitList(os.Getenv("PATH")) {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			name := strings.TrimPrefix(entry.Name(), prefix)
+			if name == entry.Name() || name == "" {
+				continue
+			}
+			if _, ok := c.rootCommand.subCommandsMap[name]; ok {
+				continue
+			}
+			path := filepath.Join(dir, entry.Name())
+			if fi, err := os.Stat(path); err != nil || !fi.Mode().IsRegular() || fi.Mode()&0111 == 0 {
+				continue
+			}
+			c.rootCommand.AddCommand(newExternalCommand(name, path))
+		}
+	}
+	return c
+}
+
+// newExternalCommand creates a command running the executable at path.
+func newExternalCommand(name, path string) *Command {
+	c := NewCommand(name, "Run "+filepath.Base(path)).
+		Action(func(ctx context.Context) error {
+			cmd := exec.CommandContext(ctx, path, OtherArgs(ctx)...)
+			cmd.Stdin = Stdin(ctx)
+			cmd.Stdout = Stdout(ctx)
+			cmd.Stderr = Stderr(ctx)
+			return cmd.Run()
+		})
+	c.noFlagParsing = true
+	c.external = true
+	return c
+}
@@ -4,14 +4,93 @@ package jcli
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"text/template"
+)
+
+// Sources of flag values
+const (
+	FlagSourceDefault     = "default"
+	FlagSourceCommandLine = "command-line"
+	FlagSourceEnv         = "env"
+	FlagSourceViper       = "viper"
+	FlagSourceProgram     = "program"
 )
 
 type flagValues struct {
-	flags  *flag.FlagSet
-	values map[string]interface{}
+	flags   *flag.FlagSet
+	values  map[string]interface{}
+	set     []string          // names of the flags given in args, sorted
+	sources map[string]string // sources of the values not from defaults
+}
+
+// countFlag is a flag counting its occurrences, as in -v -v, without a value.
+// It may also be set to a number, as in -v=2.
+type countFlag int
+
+func (c *countFlag) String() string {
+	if c == nil {
+		return "0"
+	}
+	return strconv.Itoa(int(*c))
+}
+
+func (c *countFlag) Set(s string) error {
+	if s == "true" {
+		*c++
+		return nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return err
+	}
+	*c = countFlag(n)
+	return nil
+}
+
+func (c *countFlag) IsBoolFlag() bool { return true }
+
+// byteSize is a flag of a number of bytes, given with an optional unit such as
+// 10MB or 1MiB.
+type byteSize int64
+
+// byteUnits are the multipliers of the units of byteSize, in upper case.
+var byteUnits = map[string]int64{
+	"": 1, "B": 1,
+	"K": 1000, "KB": 1000, "KIB": 1 << 10,
+	"M": 1000 * 1000, "MB": 1000 * 1000, "MIB": 1 << 20,
+	"G": 1000 * 1000 * 1000, "GB": 1000 * 1000 * 1000, "GIB": 1 << 30,
+	"T": 1000 * 1000 * 1000 * 1000, "TB": 1000 * 1000 * 1000 * 1000, "TIB": 1 << 40,
+}
+
+func (b byteSize) String() string {
+	return strconv.FormatInt(int64(b), 10)
+}
+
+func (b *byteSize) Set(s string) error {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i < 0 {
+		i = len(s)
+	}
+	unit, ok := byteUnits[strings.ToUpper(strings.TrimSpace(s[i:]))]
+	if !ok {
+		return fmt.Errorf("unknown unit in byte size %q", s)
+	}
+	n, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid byte size %q", s)
+	}
+	*b = byteSize(n * float64(unit))
+	return nil
 }
 
 type flagProto struct {
@@ -52,15 +131,63 @@ func (fp *flagProto) addFlag(flags *flag.FlagSet, vals map[string]interface{}) {
 		} else {
 			vals[fp.name] = flags.Bool(fp.name, v, fp.description)
 		}
+
+	case countFlag:
+		c := new(countFlag)
+		*c = v
+		flags.Var(c, fp.name, fp.description)
+		vals[fp.name] = c
+
+	case byteSize:
+		b := new(byteSize)
+		*b = v
+		flags.Var(b, fp.name, fp.description)
+		vals[fp.name] = b
+	}
+}
+
+// format converts a decoded JSON value to the command-line form of the flag,
+// checking that it matches the flag type.
+func (fp *flagProto) format(val interface{}) (string, error) {
+	switch fp.value.(type) {
+	case string:
+		if v, ok := val.(string); ok {
+			return v, nil
+		}
+	case int, countFlag:
+		if v, ok := val.(json.Number); ok {
+			if _, err := v.Int64(); err == nil {
+				return v.String(), nil
+			}
+		}
+	case float64:
+		if v, ok := val.(json.Number); ok {
+			return v.String(), nil
+		}
+	case byteSize:
+		switch v := val.(type) {
+		case json.Number:
+			if _, err := v.Int64(); err == nil {
+				return v.String(), nil
+			}
+		case string:
+			return v, nil
+		}
+	case bool:
+		if v, ok := val.(bool); ok {
+			return strconv.FormatBool(v), nil
+		}
 	}
+	return "", fmt.Errorf("Invalid value for flag '%s': %v", fp.name, val)
 }
 
 type flagSet struct {
 	protos map[string]*flagProto
+	noHelp bool // whether to leave out the help flag
 }
 
 func newFlagSet() *flagSet {
-	return &flagSet{make(map[string]*flagProto)}
+	return &flagSet{protos: make(map[string]*flagProto)}
 }
 
 func (fs *flagSet) flagCount() int {
@@ -71,31 +198,443 @@ func (fs *flagSet) addFlag(name, description string, val interface{}, ptr interf
 	fs.protos[name] = &flagProto{name, description, val, ptr}
 }
 
-func (fs *flagSet) parseFlags(ctx context.Context, commandPath string, args []string) (context.Context, error) {
+// newFlags creates the flag set of a command, with the persistent flags of the
+// application, which may be nil, and the help flag unless noHelp.
+func (fs *flagSet) newFlags(commandPath string, persistent *flagSet) (*flag.FlagSet, map[string]interface{}) {
 	flags := flag.NewFlagSet(commandPath, flag.ContinueOnError)
 	vals := make(map[string]interface{})
 	for _, proto := range fs.protos {
 		proto.addFlag(flags, vals)
 	}
+	if persistent != nil {
+		for _, proto := range persistent.protos {
+			if _, ok := fs.protos[proto.name]; !ok {
+				proto.addFlag(flags, vals)
+			}
+		}
+	}
+
+	if fs.noHelp {
+		return flags, vals
+	}
 
 	// add help flag here for the commandPath value; fix later
 	vals["help"] = flags.Bool("help", false,
 		"Get help on the '"+strings.ToLower(commandPath)+"' command.")
+	return flags, vals
+}
 
+// passHelp ends the flags in args before the help flag, if any, so that it is
+// taken as a positional argument when noHelp.
+func (fs *flagSet) passHelp(args []string, persistent *flagSet) []string {
+	for i := 0; i < len(args); i++ {
+		name, hasValue, ok := flagName(args[i])
+		if !ok {
+			return args
+		}
+		if name == "help" {
+			ret := append([]string{}, args[:i]...)
+			ret = append(ret, "--")
+			return append(ret, args[i:]...)
+		}
+		if proto := fs.lookup(name, persistent); proto != nil && !hasValue {
+			switch proto.value.(type) {
+			case bool, countFlag:
+			default:
+				i++ // skip the value
+			}
+		}
+	}
+	return args
+}
+
+// definesFlags returns whether the leading flags in args are all flags of the
+// command, or of the application if persistent is non-nil.
+func (fs *flagSet) definesFlags(args []string, persistent *flagSet) bool {
+	for i := 0; i < len(args); i++ {
+		name, hasValue, ok := flagName(args[i])
+		if !ok {
+			return true
+		}
+		proto := fs.lookup(name, persistent)
+		if proto == nil {
+			return false
+		}
+		if !hasValue {
+			switch proto.value.(type) {
+			case bool, countFlag:
+			default:
+				i++ // skip the value
+			}
+		}
+	}
+	return true
+}
+
+// lookup returns the flag named name of the command, or of the application if
+// persistent is non-nil, or nil if not found.
+func (fs *flagSet) lookup(name string, persistent *flagSet) *flagProto {
+	if proto, ok := fs.protos[name]; ok {
+		return proto
+	}
+	if persistent != nil {
+		return persistent.protos[name]
+	}
+	return nil
+}
+
+// flagName returns the name of the flag in arg and whether arg carries the value
+// as in -name=value. It returns false if arg is not a flag, which also ends the
+// flags in parsing.
+func flagName(arg string) (string, bool, bool) {
+	if len(arg) < 2 || arg[0] != '-' || arg == "--" {
+		return "", false, false
+	}
+	name := strings.TrimPrefix(arg[1:], "-")
+	if name == "" || name[0] == '-' || name[0] == '=' {
+		return "", false, false
+	}
+	if i := strings.IndexByte(name, '='); i >= 0 {
+		return name[:i], true, true
+	}
+	return name, false, true
+}
+
+// expandCounts rewrites repeated single-letter count flags such as -vvv to
+// -v -v -v, which the flag package does not support.
+func (fs *flagSet) expandCounts(args []string, persistent *flagSet) []string {
+	ret := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		name, hasValue, ok := flagName(arg)
+		if !ok {
+			return append(ret, args[i:]...)
+		}
+
+		proto := fs.lookup(name, persistent)
+		if proto == nil && !hasValue && strings.Trim(name, name[:1]) == "" {
+			if short := fs.lookup(name[:1], persistent); short != nil {
+				if _, isCount := short.value.(countFlag); isCount {
+					for range name {
+						ret = append(ret, "-"+name[:1])
+					}
+					continue
+				}
+			}
+		}
+
+		ret = append(ret, arg)
+		if !hasValue && proto != nil && i+1 < len(args) {
+			switch proto.value.(type) {
+			case bool, countFlag:
+			default:
+				ret = append(ret, args[i+1]) // skip the value
+				i++
+			}
+		}
+	}
+	return ret
+}
+
+// boolLiterals are the values taken by a bool flag from the next argument.
+var boolLiterals = map[string]bool{"true": true, "false": true, "1": true, "0": true}
+
+// joinBoolValues rewrites `-name value` to `-name=value` for bool flags when
+// value is one of the boolLiterals. The flag package would otherwise take value
+// as the first positional argument, so this is ambiguous for commands expecting
+// such arguments, and only done when enabled.
+func (fs *flagSet) joinBoolValues(args []string, persistent *flagSet) []string {
+	ret := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		name, hasValue, ok := flagName(arg)
+		if !ok {
+			return append(ret, args[i:]...)
+		}
+
+		proto := fs.lookup(name, persistent)
+		if !hasValue && proto != nil && i+1 < len(args) {
+			if _, isCount := proto.value.(countFlag); isCount {
+				ret = append(ret, arg)
+				continue
+			}
+			if _, isBool := proto.value.(bool); !isBool {
+				ret = append(ret, arg, args[i+1]) // skip the value
+				i++
+				continue
+			} else if boolLiterals[args[i+1]] {
+				ret = append(ret, arg+"="+args[i+1])
+				i++
+				continue
+			}
+		}
+		ret = append(ret, arg)
+	}
+	return ret
+}
+
+// parseFlags parses args against the flags of the command and the persistent
+// flags of the application, which may be nil.
+func (fs *flagSet) parseFlags(ctx context.Context, commandPath string, args []string, persistent *flagSet) (context.Context, error) {
+	flags, vals := fs.newFlags(commandPath, persistent)
 	flags.SetOutput(Stdout(ctx))
+	if fs.noHelp {
+		args = fs.passHelp(args, persistent)
+	}
+	// Before parsing, which prints the flags as undefined otherwise
+	if err := ambiguousFlag(flags, args); err != nil {
+		return ctx, err
+	}
 	if err := flags.Parse(args); err != nil {
 		return ctx, err
 	}
 
-	return context.WithValue(ctx, FlagValuesKey, &flagValues{flags, vals}), nil
+	var set []string
+	sources := make(map[string]string)
+	flags.Visit(func(f *flag.Flag) {
+		set = append(set, f.Name)
+		sources[f.Name] = FlagSourceCommandLine
+	})
+	return context.WithValue(ctx, FlagValuesKey, &flagValues{flags, vals, set, sources}), nil
+}
+
+// applyEnv sets the flags not given otherwise, as on the command line or by
+// RunWithFlags, from the environment variables named prefix_NAME, where NAME is
+// the upper-cased flag name.
+func (fv *flagValues) applyEnv(prefix string) error {
+	var err error
+	fv.flags.VisitAll(func(f *flag.Flag) {
+		if _, ok := fv.sources[f.Name]; err != nil || ok || f.Name == "help" {
+			return
+		}
+		key := prefix + "_" + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if val, ok := os.LookupEnv(key); ok {
+			if serr := fv.flags.Set(f.Name, val); serr != nil {
+				err = fmt.Errorf("Invalid value %q for flag -%s from %s: %v", val, f.Name, key, serr)
+				return
+			}
+			fv.sources[f.Name] = FlagSourceEnv
+		}
+	})
+	return err
 }
 
-func (fs *flagSet) printDefaults(ctx context.Context) {
-	if flagVals := getFlagValues(ctx); flagVals != nil {
-		out := Stdout(ctx)
-		fmt.Fprintln(out, "Flags:")
-		fmt.Fprintln(out)
-		// flagVals.flags.SetOutput(Stdout(ctx)) // set already
-		flagVals.flags.PrintDefaults()
+// applyMap sets the flags not given otherwise from the entries of m, keyed by
+// the flag names or the lower-cased ones as in viper, converting them to the
+// flag types.
+func (fv *flagValues) applyMap(m map[string]interface{}, source string) error {
+	var err error
+	fv.flags.VisitAll(func(f *flag.Flag) {
+		if _, ok := fv.sources[f.Name]; err != nil || ok || f.Name == "help" {
+			return
+		}
+		val, ok := m[f.Name]
+		if !ok {
+			val, ok = m[strings.ToLower(f.Name)]
+		}
+		if ok && val != nil {
+			str := fmt.Sprint(val)
+			if serr := fv.flags.Set(f.Name, str); serr != nil {
+				err = fmt.Errorf("Invalid value %q for flag -%s from %s: %v", str, f.Name, source, serr)
+				return
+			}
+			fv.sources[f.Name] = source
+		}
+	})
+	return err
+}
+
+// renderTemplates renders the string flags with values containing "{{" as
+// text templates, with the values of all flags by name as data, until no value
+// changes. Templates referencing each other cyclically either keep changing
+// after as many rounds as there are templates, or end up as templates still,
+// which are errors.
+func (fv *flagValues) renderTemplates() error {
+	var names []string
+	for name, ptr := range fv.values {
+		if val, ok := ptr.(*string); ok && strings.Contains(*val, "{{") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for round := 0; round <= len(names); round++ {
+		data := make(map[string]string)
+		fv.flags.VisitAll(func(f *flag.Flag) {
+			data[f.Name] = f.Value.String()
+		})
+
+		var changed []string
+		for _, name := range names {
+			val := fv.values[name].(*string)
+			tmpl, err := template.New(name).Option("missingkey=error").Parse(*val)
+			if err != nil {
+				return fmt.Errorf("Invalid template for flag -%s: %v", name, err)
+			}
+			var sb strings.Builder
+			if err := tmpl.Execute(&sb, data); err != nil {
+				return fmt.Errorf("Invalid template for flag -%s: %v", name, err)
+			}
+			if sb.String() != *val {
+				*val = sb.String()
+				changed = append(changed, name)
+			}
+		}
+		if len(changed) == 0 {
+			var cyclic []string
+			for _, name := range names {
+				if strings.Contains(*fv.values[name].(*string), "{{") {
+					cyclic = append(cyclic, name)
+				}
+			}
+			if len(cyclic) > 0 {
+				return fmt.Errorf("Cyclic templates of flags: %s", strings.Join(cyclic, ", "))
+			}
+			return nil
+		}
+		if round == len(names) {
+			return fmt.Errorf("Cyclic templates of flags: %s", strings.Join(changed, ", "))
+		}
 	}
+	return nil
+}
+
+// ambiguousFlag returns an error for the first undefined flag in args that is a
+// prefix of more than one defined flag, or nil if none.
+func ambiguousFlag(flags *flag.FlagSet, args []string) error {
+	for i := 0; i < len(args); i++ {
+		name, hasValue, ok := flagName(args[i])
+		if !ok {
+			return nil
+		}
+
+		f := flags.Lookup(name)
+		if f == nil {
+			dashes := args[i][:strings.Index(args[i], name)]
+			var matches []string
+			flags.VisitAll(func(f *flag.Flag) {
+				if strings.HasPrefix(f.Name, name) {
+					matches = append(matches, dashes+f.Name)
+				}
+			})
+			if len(matches) > 1 {
+				return fmt.Errorf("ambiguous flag %s%s: matches %s", dashes, name, strings.Join(matches, ", "))
+			}
+			continue
+		}
+
+		if bf, ok := f.Value.(interface{ IsBoolFlag() bool }); !hasValue && !(ok && bf.IsBoolFlag()) {
+			i++ // skip the value
+		}
+	}
+	return nil
+}
+
+// withArgs returns ctx with args as the positional arguments, without parsing
+// flags.
+func withArgs(ctx context.Context, commandPath string, args []string) context.Context {
+	flags := flag.NewFlagSet(commandPath, flag.ContinueOnError)
+	_ = flags.Parse(append([]string{"--"}, args...))
+	vals := make(map[string]interface{})
+	return context.WithValue(ctx, FlagValuesKey, &flagValues{flags, vals, nil, nil})
+}
+
+func (fs *flagSet) printDefaults(ctx context.Context, header, commandPath string, persistent *flagSet, skip map[string]bool) {
+	out := Stdout(ctx)
+	fmt.Fprintln(out, header)
+	fmt.Fprintln(out)
+	flags, _ := fs.newFlags(commandPath, persistent)
+	flags.VisitAll(func(f *flag.Flag) {
+		if skip[f.Name] {
+			return
+		}
+		var sb strings.Builder
+		sb.WriteString("  -" + f.Name)
+		name, usage := flag.UnquoteUsage(f)
+		if name != "" {
+			sb.WriteString(" " + name)
+		}
+		// Short names fit on the same line, as in flag.PrintDefaults
+		if len(sb.String()) <= 4 {
+			sb.WriteString("\t")
+		} else {
+			sb.WriteString("\n    \t")
+		}
+		sb.WriteString(strings.ReplaceAll(usage, "\n", "\n    \t"))
+
+		var val interface{}
+		if proto := fs.lookup(f.Name, persistent); proto != nil {
+			val = proto.value
+		}
+		switch v := val.(type) {
+		case nil:
+		case bool:
+			if v {
+				sb.WriteString(" (default: true)")
+			}
+		case string:
+			if v != "" {
+				fmt.Fprintf(&sb, " (default: %q)", v)
+			}
+		case countFlag:
+			if v != 0 {
+				fmt.Fprintf(&sb, " (default: %d)", v)
+			}
+		default:
+			fmt.Fprintf(&sb, " (default: %v)", v)
+		}
+		fmt.Fprintln(out, sb.String())
+	})
+}
+
+// explainFlags prints the value of each flag and where it came from.
+func explainFlags(ctx context.Context) error {
+	flagVals := getFlagValues(ctx)
+	if flagVals == nil {
+		return nil
+	}
+	out := Stdout(ctx)
+	var err error
+	flagVals.flags.VisitAll(func(f *flag.Flag) {
+		if err == nil && f.Name != "help" && f.Name != "explain-flags" {
+			_, err = fmt.Fprintf(out, "%s=%s (%s)\n", f.Name, f.Value, FlagSource(ctx, f.Name))
+		}
+	})
+	return err
+}
+
+// FlagGroup is a set of flags shared by commands, such as for pagination, which
+// shows as its own section in help.
+type FlagGroup struct {
+	name  string
+	flags *flagSet
+}
+
+// NewFlagGroup creates an empty flag group, named for its help section.
+func NewFlagGroup(name string) *FlagGroup {
+	return &FlagGroup{name, newFlagSet()}
+}
+
+// BoolFlag - Adds a boolean flag to the group
+func (g *FlagGroup) BoolFlag(name, description string, val bool) *FlagGroup {
+	g.flags.addFlag(name, description, val, nil)
+	return g
+}
+
+// StringFlag - Adds a string flag to the group
+func (g *FlagGroup) StringFlag(name, description string, val string) *FlagGroup {
+	g.flags.addFlag(name, description, val, nil)
+	return g
+}
+
+// IntFlag - Adds an int flag to the group
+func (g *FlagGroup) IntFlag(name, description string, val int) *FlagGroup {
+	g.flags.addFlag(name, description, val, nil)
+	return g
+}
+
+// FloatFlag - Adds a float flag to the group
+func (g *FlagGroup) FloatFlag(name, description string, val float64) *FlagGroup {
+	g.flags.addFlag(name, description, val, nil)
+	return g
 }
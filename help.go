@@ -0,0 +1,139 @@
+// Copyright (c) 2021 Jing-Ying Chen. Subject to the MIT License.
+
+package jcli
+
+import (
+	"encoding/json"
+	"flag"
+)
+
+// HelpData is the help of a command as data, for rendering by callers.
+type HelpData struct {
+	Name            string
+	Path            string
+	Version         string
+	Description     string
+	LongDescription string
+	Commands        []HelpCommand // visible subcommands, in the order added
+	Flags           []FlagHelp    // flags including persistent ones, sorted
+}
+
+// FlagHelp describes a flag in HelpData.
+type FlagHelp struct {
+	Name        string
+	Description string
+	Default     string
+}
+
+// HelpCommand describes a subcommand in HelpData.
+type HelpCommand struct {
+	Name            string
+	Description     string
+	LongDescription string
+	Default         bool
+	External        bool
+}
+
+// HelpData - Returns the help of the application as data.
+func (c *Cli) HelpData() HelpData {
+	return c.rootCommand.HelpData()
+}
+
+// HelpData - Returns the help of the command as data
+func (c *Command) HelpData() HelpData {
+	data := HelpData{
+		Name:            c.name,
+		Path:            c.commandPath(),
+		Description:     c.shortdescription,
+		LongDescription: c.longdescription,
+	}
+	var persistent *flagSet
+	if app := c.getCli(); app != nil {
+		data.Version = app.version
+		persistent = app.persistentFlags
+	}
+	flags, _ := c.flags.newFlags(c.commandPath(), persistent)
+	flags.VisitAll(func(f *flag.Flag) {
+		if f.Name != "help" {
+			data.Flags = append(data.Flags, FlagHelp{f.Name, f.Usage, f.DefValue})
+		}
+	})
+	for _, subcommand := range c.subCommands {
+		if !subcommand.isHidden() {
+			data.Commands = append(data.Commands, HelpCommand{
+				Name:            subcommand.name,
+				Description:     subcommand.shortdescription,
+				LongDescription: subcommand.longdescription,
+				Default:         subcommand.isDefaultCommand(),
+				External:        subcommand.external,
+			})
+		}
+	}
+	return data
+}
+
+// CommandDescription describes a command and its visible subcommands, for
+// tools such as documentation generators.
+type CommandDescription struct {
+	Name        string               `json:"name"`
+	Path        string               `json:"path"`
+	Description string               `json:"description"`
+	Flags       []string             `json:"flags,omitempty"`
+	Meta        map[string]string    `json:"meta,omitempty"`
+	Commands    []CommandDescription `json:"commands,omitempty"`
+}
+
+// Describe - Returns the description of the command tree of the application
+func (c *Cli) Describe() CommandDescription {
+	return c.rootCommand.Describe()
+}
+
+// DescribeJSON - Returns the description of the command tree of the
+// application as indented JSON
+func (c *Cli) DescribeJSON() ([]byte, error) {
+	return c.rootCommand.DescribeJSON()
+}
+
+// Describe - Returns the description of the command and its visible
+// subcommands, recursively
+func (c *Command) Describe() CommandDescription {
+	return c.describe(maxDepth)
+}
+
+func (c *Command) describe(depth int) CommandDescription {
+	desc := CommandDescription{
+		Name:        c.name,
+		Path:        c.commandPath(),
+		Description: c.shortdescription,
+		Flags:       c.FlagNames(),
+	}
+	if len(c.meta) > 0 {
+		desc.Meta = make(map[string]string, len(c.meta))
+		for key, value := range c.meta {
+			desc.Meta[key] = value
+		}
+	}
+	if depth > 0 {
+		for _, subcommand := range c.subCommands {
+			if !subcommand.isHidden() {
+				desc.Commands = append(desc.Commands, subcommand.describe(depth-1))
+			}
+		}
+	}
+	return desc
+}
+
+// DescribeJSON - Returns the description of the command as indented JSON
+func (c *Command) DescribeJSON() ([]byte, error) {
+	return json.MarshalIndent(c.Describe(), "", "  ")
+}
+
+func longestName(commands []HelpCommand) int {
+	var longest int
+	for _, command := range commands {
+		if n := len(command.Name); n > longest {
+			longest = n
+		}
+	}
+	return longest
+}
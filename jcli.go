@@ -27,23 +27,71 @@
 package jcli
 
 import (
+	"bufio"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 )
 
 const (
 	FlagValuesKey = "__flag_values__"
 	StdoutKey     = "__stdout__"
+	StderrKey     = "__stderr__"
+	StdinKey      = "__stdin__"
 	PrintJsonKey  = "__print_json__"
 	QuietKey      = "__quiet__"
+	RequestIDKey  = "__request_id__"
+	RawArgsKey    = "__raw_args__"
+	DeferKey      = "__defer__"
+	CliKey        = "__cli__"
+	StreamKey     = "__stream__"
+	NamedArgsKey  = "__named_args__"
+	SeedFlagsKey  = "__seed_flags__"
+	EventsKey     = "__events__"
+)
+
+// Keys of the user-facing messages, which are also the format strings of the
+// English messages; see Cli.MessageTranslator.
+const (
+	MsgUsageError        = "Error: %s\nSee '%s --help' for usage"
+	MsgAvailableCommands = "Available commands:"
+	MsgFlags             = "Flags:"
+	MsgGroupFlags        = "%s flags:"
+	MsgExamples          = "Examples:"
+	MsgDefault           = "[default]"
+	MsgExternal          = "[external]"
+	MsgDeprecatedName    = "Warning: %q is deprecated, use %q"
 )
 
 var ErrHelp = errors.New("jcli: help requested")
 
+var ErrReservedName = errors.New("jcli: reserved name")
+
+var ErrRecursionLimit = errors.New("jcli: command recursion limit exceeded")
+
+var ErrNoAction = errors.New("jcli: command has no action or subcommands")
+
+var ErrConcurrencyLimit = errors.New("jcli: command concurrency limit reached")
+
+// ErrShowHelp is returned by actions to print the help of their command, e.g.
+// on invalid arguments. It is not an error of the run itself.
+var ErrShowHelp = errors.New("jcli: show help")
+
+// reservedNames are names used by jcli itself, for flags and commands.
+var reservedNames = map[string]bool{
+	"help": true,
+}
+
 // defaultBannerFunction prints a banner for the application.
 // If version is a blank string, it is ignored.
 func defaultBannerFunction(ctx context.Context, c *Cli) string {
@@ -79,6 +127,20 @@ func IntFlag(ctx context.Context, name string, otherwise int) int {
 	return otherwise
 }
 
+// Verbosity returns the number of times the flags of Cli.VerbosityFlag are
+// given, 0 by default.
+func Verbosity(ctx context.Context) int {
+	var n int
+	for _, name := range []string{"verbose", "v"} {
+		if ptr, ok := getValuePointer(ctx, name); ok {
+			if count, ok := ptr.(*countFlag); ok {
+				n += int(*count)
+			}
+		}
+	}
+	return n
+}
+
 func FloatFlag(ctx context.Context, name string, otherwise float64) float64 {
 	if ptr, ok := getValuePointer(ctx, name); ok {
 		if ret, ok := ptr.(*float64); ok {
@@ -88,6 +150,17 @@ func FloatFlag(ctx context.Context, name string, otherwise float64) float64 {
 	return otherwise
 }
 
+// ByteSizeFlag returns the number of bytes of the flag added by
+// Command.ByteSizeFlag, or otherwise if not found.
+func ByteSizeFlag(ctx context.Context, name string, otherwise int64) int64 {
+	if ptr, ok := getValuePointer(ctx, name); ok {
+		if ret, ok := ptr.(*byteSize); ok {
+			return int64(*ret)
+		}
+	}
+	return otherwise
+}
+
 func StringFlag(ctx context.Context, name, otherwise string) string {
 	if ptr, ok := getValuePointer(ctx, name); ok {
 		if ret, ok := ptr.(*string); ok {
@@ -116,6 +189,52 @@ func BoolFlag(ctx context.Context, name string, otherwise bool) bool {
 	return otherwise
 }
 
+// FlagReader reads the parsed flag values of a context, returning zero values
+// for flags missing or of other types.
+type FlagReader struct {
+	vals *flagValues
+}
+
+// Flags returns the FlagReader of ctx.
+func Flags(ctx context.Context) FlagReader {
+	return FlagReader{getFlagValues(ctx)}
+}
+
+func (r FlagReader) lookup(name string) interface{} {
+	if r.vals != nil {
+		return r.vals.values[name]
+	}
+	return nil
+}
+
+func (r FlagReader) String(name string) string {
+	if ptr, ok := r.lookup(name).(*string); ok {
+		return *ptr
+	}
+	return ""
+}
+
+func (r FlagReader) Int(name string) int {
+	if ptr, ok := r.lookup(name).(*int); ok {
+		return *ptr
+	}
+	return 0
+}
+
+func (r FlagReader) Bool(name string) bool {
+	if ptr, ok := r.lookup(name).(*bool); ok {
+		return *ptr
+	}
+	return false
+}
+
+func (r FlagReader) Float(name string) float64 {
+	if ptr, ok := r.lookup(name).(*float64); ok {
+		return *ptr
+	}
+	return 0
+}
+
 func HelpFlag(ctx context.Context) bool {
 	return BoolFlag(ctx, "help", false)
 }
@@ -127,6 +246,292 @@ func OtherArgs(ctx context.Context) []string {
 	return nil
 }
 
+// SetFlags returns the names of the flags explicitly given on the command line,
+// in lexicographical order, as opposed to those left to their defaults.
+func SetFlags(ctx context.Context) []string {
+	if flagVals := getFlagValues(ctx); flagVals != nil {
+		return flagVals.set
+	}
+	return nil
+}
+
+// FlagSource returns where the value of the flag came from, such as
+// FlagSourceCommandLine, or FlagSourceDefault if not given.
+func FlagSource(ctx context.Context, name string) string {
+	if flagVals := getFlagValues(ctx); flagVals != nil {
+		if source, ok := flagVals.sources[name]; ok {
+			return source
+		}
+	}
+	return FlagSourceDefault
+}
+
+// BindFlags copies the parsed flag values into the fields of the struct pointed
+// to by ptr, matching flags by the jcli tag of the fields, or else by the field
+// names as is or lower-cased. Fields tagged `jcli:"-"` or without a matching
+// flag are left alone; a field of another type than its flag is an error.
+func BindFlags(ctx context.Context, ptr interface{}) error {
+	v := reflect.ValueOf(ptr)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("Cannot bind flags to %T, need a pointer to struct", ptr)
+	}
+	flagVals := getFlagValues(ctx)
+	if flagVals == nil {
+		return nil
+	}
+
+	v = v.Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" { // unexported
+			continue
+		}
+
+		var names []string
+		if tag, ok := field.Tag.Lookup("jcli"); ok {
+			if tag == "-" {
+				continue
+			}
+			names = []string{tag}
+		} else {
+			names = []string{field.Name, strings.ToLower(field.Name)}
+		}
+
+		for _, name := range names {
+			ptr, ok := flagVals.values[name]
+			if !ok {
+				continue
+			}
+			val := reflect.ValueOf(ptr).Elem()
+			if !val.Type().AssignableTo(field.Type) {
+				return fmt.Errorf("Cannot bind flag -%s of type %s to field %s of type %s",
+					name, val.Type(), field.Name, field.Type)
+			}
+			v.Field(i).Set(val)
+			break
+		}
+	}
+	return nil
+}
+
+// StringArg returns the positional argument named by Command.Arg, or its
+// default if not given.
+func StringArg(ctx context.Context, name string) string {
+	args, _ := ctx.Value(NamedArgsKey).(map[string]string)
+	return args[name]
+}
+
+// RawArgs returns the arguments following the command name as given, before
+// parsing flags, joined with spaces.
+func RawArgs(ctx context.Context) string {
+	args, _ := ctx.Value(RawArgsKey).([]string)
+	return strings.Join(args, " ")
+}
+
+// CommandSnapshot is the parsed invocation of a command, for logging and
+// reproducing it, e.g. on failure.
+type CommandSnapshot struct {
+	Path  string            `json:"path"`
+	Flags map[string]string `json:"flags,omitempty"` // values not from defaults
+	Args  []string          `json:"args,omitempty"`
+}
+
+// Snapshot returns the command path, the flags not left to their defaults and
+// the positional arguments of the command run with ctx.
+func Snapshot(ctx context.Context) CommandSnapshot {
+	flagVals := getFlagValues(ctx)
+	if flagVals == nil {
+		return CommandSnapshot{}
+	}
+	snap := CommandSnapshot{
+		Path: flagVals.flags.Name(),
+		Args: flagVals.flags.Args(),
+	}
+	for name := range flagVals.sources {
+		if f := flagVals.flags.Lookup(name); f != nil {
+			if snap.Flags == nil {
+				snap.Flags = make(map[string]string)
+			}
+			snap.Flags[name] = f.Value.String()
+		}
+	}
+	return snap
+}
+
+// String returns the snapshot as a command line, with the flags sorted.
+func (s CommandSnapshot) String() string {
+	names := make([]string, 0, len(s.Flags))
+	for name := range s.Flags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	words := []string{s.Path}
+	for _, name := range names {
+		words = append(words, "-"+name+"="+quoteWord(s.Flags[name]))
+	}
+	if len(s.Args) > 0 {
+		words = append(words, "--")
+		for _, arg := range s.Args {
+			words = append(words, quoteWord(arg))
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// quoteWord quotes s if empty or containing spaces or quotes.
+func quoteWord(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\n\"'") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// ResolveInput returns the value of the string flag if given, or else the first
+// positional argument, for inputs that can be given either way.
+func ResolveInput(ctx context.Context, flagName string) (string, error) {
+	if FlagSource(ctx, flagName) != FlagSourceDefault {
+		return StringFlag(ctx, flagName, ""), nil
+	}
+	if args := OtherArgs(ctx); len(args) > 0 {
+		return args[0], nil
+	}
+	return "", fmt.Errorf("Missing input: give --%s or an argument", flagName)
+}
+
+// Defer registers fn to run after the action of the current command returns,
+// after other cleanups of the run, in LIFO order. Errors from fn are joined to
+// the error of the run. Outside of a command run, fn is not called.
+func Defer(ctx context.Context, fn func() error) {
+	if stack, ok := ctx.Value(DeferKey).(*deferStack); ok {
+		stack.push(fn)
+	}
+}
+
+type deferStack struct {
+	mu  sync.Mutex
+	fns []func() error
+}
+
+func (s *deferStack) push(fn func() error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fns = append(s.fns, fn)
+}
+
+// run calls the functions in LIFO order and returns err joined with their errors.
+func (s *deferStack) run(err error) error {
+	s.mu.Lock()
+	fns := s.fns
+	s.fns = nil
+	s.mu.Unlock()
+
+	errs := []error{err}
+	for i := len(fns) - 1; i >= 0; i-- {
+		errs = append(errs, fns[i]())
+	}
+	return joinErrors(errs...)
+}
+
+// joinedError is the error of joinErrors.
+type joinedError []error
+
+func (e joinedError) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+func (e joinedError) Unwrap() []error {
+	return e
+}
+
+// Is and As match the joined errors for errors.Is and errors.As, which only
+// use Unwrap() []error from Go 1.20.
+func (e joinedError) Is(target error) bool {
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e joinedError) As(target interface{}) bool {
+	for _, err := range e {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// joinErrors returns the non-nil errs joined into one error, or nil if none;
+// like errors.Join, unavailable before Go 1.20.
+func joinErrors(errs ...error) error {
+	var ret joinedError
+	for _, err := range errs {
+		if err != nil {
+			ret = append(ret, err)
+		}
+	}
+	switch len(ret) {
+	case 0:
+		return nil
+	case 1:
+		return ret[0]
+	}
+	return ret
+}
+
+// GetCli returns the Cli running the command, or nil if none.
+func GetCli(ctx context.Context) *Cli {
+	if cli, ok := ctx.Value(CliKey).(*Cli); ok {
+		return cli
+	}
+	return nil
+}
+
+// Stream returns the channel an action sends its items to when run by
+// Cli.RunChan, or nil otherwise. The channel is closed by RunChan once the
+// action returns, so actions should not close it or send to it afterwards.
+func Stream(ctx context.Context) chan<- interface{} {
+	ch, _ := ctx.Value(StreamKey).(chan interface{})
+	return ch
+}
+
+// Event is a progress event of an action, such as "copied" with the number of
+// files copied so far.
+type Event struct {
+	Name string
+	Data interface{}
+}
+
+// WithEvents returns ctx with the channel EmitEvent sends events to. The channel
+// belongs to the caller and is never closed by jcli; it should be buffered
+// enough or drained concurrently, e.g. while calling Cli.RunBuffer.
+func WithEvents(ctx context.Context, events chan<- Event) context.Context {
+	return context.WithValue(ctx, EventsKey, events)
+}
+
+// EmitEvent sends the event to the channel given to WithEvents, if any, waiting
+// until it is received or ctx is done.
+func EmitEvent(ctx context.Context, event Event) error {
+	events, _ := ctx.Value(EventsKey).(chan<- Event)
+	if events == nil {
+		return nil
+	}
+	select {
+	case events <- event:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func Stdout(ctx context.Context) io.Writer {
 	if w, ok := ctx.Value(StdoutKey).(io.Writer); ok && w != nil {
 		return w
@@ -134,6 +539,62 @@ func Stdout(ctx context.Context) io.Writer {
 	return os.Stdout
 }
 
+// Stdin returns the input of the command, os.Stdin unless set by WithStdin.
+func Stdin(ctx context.Context) io.Reader {
+	if r, ok := ctx.Value(StdinKey).(io.Reader); ok && r != nil {
+		return r
+	}
+	return os.Stdin
+}
+
+func WithStdin(ctx context.Context, r io.Reader) context.Context {
+	return context.WithValue(ctx, StdinKey, r)
+}
+
+// StdinIsPipe returns whether Stdin(ctx) is piped or redirected rather than a
+// terminal, which is also the case for readers other than files, e.g. set by
+// WithStdin. Actions can then read their input from it when no file is given:
+//
+//	var in io.Reader
+//	if args := OtherArgs(ctx); len(args) > 0 {
+//		f, err := os.Open(args[0])
+//		...
+//		in = f
+//	} else if StdinIsPipe(ctx) {
+//		in = Stdin(ctx)
+//	}
+func StdinIsPipe(ctx context.Context) bool {
+	r := Stdin(ctx)
+	if _, ok := r.(*os.File); !ok {
+		return true
+	}
+	return !isCharDevice(r)
+}
+
+// IsTerminal returns whether Stdout(ctx) is a file for a character device, such
+// as a terminal, as opposed to a pipe, a regular file or an in-memory writer.
+func IsTerminal(ctx context.Context) bool {
+	return isCharDevice(Stdout(ctx))
+}
+
+func isCharDevice(v interface{}) bool {
+	f, ok := v.(*os.File)
+	if !ok {
+		return false
+	}
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// Flush writes the buffered output, if Stdout(ctx) is buffered, as with
+// Cli.BufferOutput.
+func Flush(ctx context.Context) error {
+	if w, ok := Stdout(ctx).(*bufio.Writer); ok {
+		return w.Flush()
+	}
+	return nil
+}
+
 func Quiet(ctx context.Context) bool {
 	b, ok := ctx.Value(QuietKey).(bool)
 	return ok && b
@@ -148,6 +609,33 @@ func WithStdout(ctx context.Context, w io.Writer) context.Context {
 	return context.WithValue(ctx, StdoutKey, w)
 }
 
+func Stderr(ctx context.Context) io.Writer {
+	if w, ok := ctx.Value(StderrKey).(io.Writer); ok && w != nil {
+		return w
+	}
+	return os.Stderr
+}
+
+func WithStderr(ctx context.Context, w io.Writer) context.Context {
+	return context.WithValue(ctx, StderrKey, w)
+}
+
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(RequestIDKey).(string)
+	return id
+}
+
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, RequestIDKey, id)
+}
+
+// newRequestID returns a random 128-bit ID in hex.
+func newRequestID() string {
+	var buf [16]byte
+	_, _ = rand.Read(buf[:])
+	return hex.EncodeToString(buf[:])
+}
+
 func Printf(ctx context.Context, format string, args ...interface{}) error {
 	var err error
 	if w, ok := ctx.Value(StdoutKey).(io.Writer); ok {
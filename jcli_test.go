@@ -3,10 +3,24 @@
 package jcli
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"plugin"
 	"reflect"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestBasic(t *testing.T) {
@@ -93,3 +107,2724 @@ func TestBasic(t *testing.T) {
 		t.Fatalf("Should be 'This is default', got '%s'", string(ret))
 	}
 }
+
+func TestChdirFlag(t *testing.T) {
+	var wd string
+	cli := NewCli("Chdir", "Test chdir", "0").ChdirFlag()
+	cli.NewSubCommand("pwd", "Print working directory").
+		Action(func(ctx context.Context) error {
+			var err error
+			wd, err = os.Getwd()
+			return err
+		})
+
+	orig, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if err := cli.Run(ctx, "pwd", "-C", dir); err != nil {
+		t.Fatal(err)
+	}
+	if wd != dir {
+		t.Fatalf("expect cwd '%s', got '%s'", dir, wd)
+	}
+	if cur, _ := os.Getwd(); cur != orig {
+		t.Fatalf("cwd not restored: '%s' vs. '%s'", cur, orig)
+	}
+
+	if err := cli.Run(ctx, "pwd", "--chdir", filepath.Join(dir, "missing")); err == nil {
+		t.Fatal("Should fail with missing directory")
+	}
+
+	// A command's own chdir flag is not the persistent one
+	cli.NewSubCommand("clone", "Clone into a directory").
+		StringFlag("C", "Directory to clone into", "").
+		Action(func(ctx context.Context) error {
+			var err error
+			wd, err = os.Getwd()
+			return err
+		})
+	if err := cli.Run(ctx, "clone", "-C", dir); err != nil {
+		t.Fatal(err)
+	}
+	if wd != orig {
+		t.Fatalf("expect cwd '%s', got '%s'", orig, wd)
+	}
+}
+
+func TestRunJSON(t *testing.T) {
+	var name string
+	var count int
+	var loud bool
+	cli := NewCli("JSON", "Test JSON input", "0")
+	cli.NewSubCommand("greet", "Greet").
+		StringFlag("name", "Name", "").
+		IntFlag("count", "Count", 1).
+		BoolFlag("loud", "Loud", false).
+		Action(func(ctx context.Context) error {
+			name = StringFlag(ctx, "name", "")
+			count = IntFlag(ctx, "count", 0)
+			loud = BoolFlag(ctx, "loud", false)
+			return Printf(ctx, "Hello %s", name)
+		})
+
+	ctx := context.Background()
+	out, err := cli.RunJSON(ctx, "greet", json.RawMessage(`{"name": "you", "count": 3, "loud": true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "Hello you" || name != "you" || count != 3 || !loud {
+		t.Fatalf("unexpected result: %q %q %d %v", out, name, count, loud)
+	}
+
+	if _, err := cli.RunJSON(ctx, "greet", json.RawMessage(`{"nmae": "you"}`)); err == nil {
+		t.Fatal("Should fail with unknown field `nmae`")
+	}
+	if _, err := cli.RunJSON(ctx, "greet", json.RawMessage(`{"count": "3"}`)); err == nil {
+		t.Fatal("Should fail with mistyped field `count`")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cli := NewCli("Validate", "Test validate", "0")
+	cli.NewSubCommand("hello", "Hello").StringFlag("name", "Name", "")
+	if err := cli.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	cli.NewSubCommand("help", "Help")
+	if err := cli.Validate(); !errors.Is(err, ErrReservedName) {
+		t.Fatalf("expect ErrReservedName, got %v", err)
+	}
+	if err := cli.AllowReserved("help").Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	cli.NewSubCommand("bye", "Bye").BoolFlag("help", "Help", false)
+	if err := cli.Validate(); !errors.Is(err, ErrReservedName) {
+		t.Fatalf("expect ErrReservedName, got %v", err)
+	}
+}
+
+type fakePlugin map[string]plugin.Symbol
+
+func (p fakePlugin) Lookup(name string) (plugin.Symbol, error) {
+	if sym, ok := p[name]; ok {
+		return sym, nil
+	}
+	return nil, fmt.Errorf("symbol %s not found", name)
+}
+
+func TestLoadPlugin(t *testing.T) {
+	plugins := map[string]fakePlugin{
+		"good.so": {PluginSymbol: func() []*Command {
+			return []*Command{
+				NewCommand("hello", "Hello").Action(func(ctx context.Context) error {
+					return Printf(ctx, "Hello from plugin")
+				}),
+			}
+		}},
+		"empty.so": {},
+		"wrong.so": {PluginSymbol: func() *Command { return nil }},
+	}
+	defer func(open func(string) (pluginLookup, error)) { openPlugin = open }(openPlugin)
+	openPlugin = func(path string) (pluginLookup, error) {
+		if p, ok := plugins[path]; ok {
+			return p, nil
+		}
+		return nil, fmt.Errorf("cannot open %s", path)
+	}
+
+	cli := NewCli("Plugin", "Test plugin", "0")
+	for _, path := range []string{"missing.so", "empty.so", "wrong.so"} {
+		if err := cli.LoadPlugin(path); err == nil {
+			t.Fatalf("Should fail loading '%s'", path)
+		}
+	}
+	if err := cli.LoadPlugin("good.so"); err != nil {
+		t.Fatal(err)
+	}
+
+	ret, err := cli.RunBuffer(context.Background(), false, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(ret) != "Hello from plugin" {
+		t.Fatalf("Should be 'Hello from plugin', got '%s'", string(ret))
+	}
+}
+
+func TestHelpString(t *testing.T) {
+	cli := NewCli("Help", "Test help", "1.0").LongDescription("Long description.")
+	cli.NewSubCommand("hello", "Hello").StringFlag("name", "Your name", "")
+
+	ctx := context.Background()
+	buf := new(bytes.Buffer)
+	cli.PrintHelp(WithStdout(ctx, buf))
+	help := cli.HelpString(ctx)
+	if help != buf.String() {
+		t.Fatalf("Not the same: %q vs. %q", help, buf.String())
+	}
+	for _, s := range []string{"Help 1.0 - Test help", "Long description.", "hello", "Hello"} {
+		if !strings.Contains(help, s) {
+			t.Fatalf("expect '%s' in help, got %q", s, help)
+		}
+	}
+
+	sub := cli.rootCommand.subCommandsMap["hello"].HelpString(ctx)
+	if !strings.Contains(sub, "-name string") || !strings.Contains(sub, "Your name") {
+		t.Fatalf("expect flag 'name' in help, got %q", sub)
+	}
+}
+
+func TestPreset(t *testing.T) {
+	var color, quiet bool
+	var format string
+	var args []string
+	cli := NewCli("Preset", "Test presets", "0").
+		Preset("ci", "--color=false", "--quiet", "--format", "json")
+	cli.NewSubCommand("build", "Build").
+		BoolFlag("color", "Color", true).
+		BoolFlag("quiet", "Quiet", false).
+		StringFlag("format", "Format", "text").
+		Action(func(ctx context.Context) error {
+			color = BoolFlag(ctx, "color", true)
+			quiet = BoolFlag(ctx, "quiet", false)
+			format = StringFlag(ctx, "format", "")
+			args = OtherArgs(ctx)
+			return nil
+		})
+
+	ctx := context.Background()
+	if err := cli.Run(ctx, "build", "--preset", "ci"); err != nil {
+		t.Fatal(err)
+	}
+	if color || !quiet || format != "json" {
+		t.Fatalf("preset not applied: %v %v %q", color, quiet, format)
+	}
+
+	if err := cli.Run(ctx, "build", "--preset=ci", "--format", "yaml"); err != nil {
+		t.Fatal(err)
+	}
+	if format != "yaml" {
+		t.Fatalf("expect format 'yaml', got '%s'", format)
+	}
+
+	if err := cli.Run(ctx, "build", "--preset", "cd"); err == nil {
+		t.Fatal("Should fail with unknown preset `cd`")
+	}
+
+	// Not expanded after the flags, as an argument of the action
+	if err := cli.Run(ctx, "build", "--format", "yaml", "script", "--preset", "ci"); err != nil {
+		t.Fatal(err)
+	}
+	if format != "yaml" || !reflect.DeepEqual(args, []string{"script", "--preset", "ci"}) {
+		t.Fatalf("expect the preset kept as an argument, got %q %v", format, args)
+	}
+}
+
+func TestVersionCommand(t *testing.T) {
+	cli := NewCli("Version", "Test version", "1.2.3")
+	cli.VersionCommand()
+
+	ctx := context.Background()
+	ret, err := cli.RunBuffer(ctx, false, "version", "--short")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(ret) != "1.2.3\n" {
+		t.Fatalf("Should be '1.2.3\\n', got %q", string(ret))
+	}
+
+	ret, err = cli.RunBuffer(ctx, false, "version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(ret) != "Version 1.2.3 - Test version\n" {
+		t.Fatalf("Should be the banner, got %q", string(ret))
+	}
+}
+
+func TestNewViperMerged(t *testing.T) {
+	dir := t.TempDir()
+	system := filepath.Join(dir, "system.yaml")
+	project := filepath.Join(dir, "project.yaml")
+	if err := os.WriteFile(system, []byte("name: system\nport: 80\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(project, []byte("name: project\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	vip, err := NewViperMerged(system, filepath.Join(dir, "user.yaml"), project)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := vip.GetString("name"); name != "project" {
+		t.Fatalf("expect name 'project', got '%s'", name)
+	}
+	if port := vip.GetInt("port"); port != 80 {
+		t.Fatalf("expect port 80, got %d", port)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	var id string
+	cli := NewCli("RequestID", "Test request ID", "0").
+		WithRequestID(true).
+		Action(func(ctx context.Context) error {
+			id = RequestID(ctx)
+			return nil
+		})
+
+	ctx := context.Background()
+	if err := cli.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if id == "" {
+		t.Fatal("expect a request ID")
+	}
+	first := id
+
+	if err := cli.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if id == first {
+		t.Fatalf("expect a new request ID, got '%s' again", id)
+	}
+
+	if err := cli.Run(WithRequestID(ctx, "req-1")); err != nil {
+		t.Fatal(err)
+	}
+	if id != "req-1" {
+		t.Fatalf("expect request ID 'req-1', got '%s'", id)
+	}
+}
+
+func TestSetFlags(t *testing.T) {
+	var set []string
+	cli := NewCli("SetFlags", "Test set flags", "0").
+		StringFlag("name", "Name", "").
+		IntFlag("count", "Count", 1).
+		BoolFlag("loud", "Loud", false).
+		Action(func(ctx context.Context) error {
+			set = SetFlags(ctx)
+			return nil
+		})
+
+	if err := cli.Run(context.Background(), "--name", "you", "--loud=false", "rest"); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"loud", "name"}; !reflect.DeepEqual(set, expected) {
+		t.Fatalf("Not the same: %+v vs. %+v", set, expected)
+	}
+}
+
+func TestOutputTransform(t *testing.T) {
+	cli := NewCli("Transform", "Test output transform", "0").
+		OutputTransform(func(s string) string {
+			return strings.TrimSpace(s) + "\n"
+		}).
+		Action(func(ctx context.Context) error {
+			return Printf(ctx, "  hello \n\n")
+		})
+
+	ret, err := cli.RunBuffer(context.Background(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(ret) != "hello\n" {
+		t.Fatalf("Should be 'hello\\n', got %q", string(ret))
+	}
+}
+
+func TestExplainFlags(t *testing.T) {
+	ran := false
+	cli := NewCli("Explain", "Test explain flags", "0").ExplainFlags(true)
+	cli.NewSubCommand("hello", "Hello").
+		StringFlag("name", "Name", "").
+		IntFlag("count", "Count", 1).
+		Action(func(ctx context.Context) error {
+			ran = true
+			return nil
+		})
+
+	ret, err := cli.RunBuffer(context.Background(), false, "hello", "--name", "you", "--explain-flags")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ran {
+		t.Fatal("action should not run")
+	}
+	expected := "count=1 (default)\nname=you (command-line)\n"
+	if string(ret) != expected {
+		t.Fatalf("Should be %q, got %q", expected, string(ret))
+	}
+}
+
+func TestFlagNames(t *testing.T) {
+	cli := NewCli("Complete", "Test completion", "0")
+	hello := cli.NewSubCommand("hello", "Hello").
+		StringFlag("name", "Name", "").
+		BoolFlag("loud", "Loud", false)
+	cli.NewSubCommand("help-me", "Help me")
+
+	if names, expected := hello.FlagNames(), []string{"loud", "name"}; !reflect.DeepEqual(names, expected) {
+		t.Fatalf("Not the same: %+v vs. %+v", names, expected)
+	}
+
+	if ret, expected := cli.completeLine(context.Background(), "hello --l"), []string{"hello --loud"}; !reflect.DeepEqual(ret, expected) {
+		t.Fatalf("Not the same: %+v vs. %+v", ret, expected)
+	}
+	if ret, expected := cli.completeLine(context.Background(), "he"), []string{"hello", "help-me"}; !reflect.DeepEqual(ret, expected) {
+		t.Fatalf("Not the same: %+v vs. %+v", ret, expected)
+	}
+}
+
+func TestRecursionLimit(t *testing.T) {
+	// remote falls back to its default subcommand show, which has no action
+	// and falls back to the default command remote again
+	cli := NewCli("Recursion", "Test recursion limit", "0")
+	remote := cli.NewSubCommand("remote", "Remote")
+	show := NewCommand("show", "Show")
+	show.NewSubCommand("url", "Show url").Action(func(ctx context.Context) error {
+		return nil
+	})
+	remote.DefaultSubCommand(show)
+	cli.DefaultCommand(remote)
+
+	if err := cli.Run(context.Background()); !errors.Is(err, ErrRecursionLimit) {
+		t.Fatalf("expect ErrRecursionLimit, got %v", err)
+	}
+}
+
+func TestExplicitBoolValues(t *testing.T) {
+	var verbose bool
+	var args []string
+	cli := NewCli("Bools", "Test explicit bool values", "0").
+		StringFlag("name", "Name", "").
+		BoolFlag("verbose", "Verbose", false, &verbose).
+		Action(func(ctx context.Context) error {
+			args = OtherArgs(ctx)
+			return nil
+		})
+
+	ctx := context.Background()
+	if err := cli.Run(ctx, "--verbose", "true"); err != nil {
+		t.Fatal(err)
+	}
+	if !verbose || !reflect.DeepEqual(args, []string{"true"}) {
+		t.Fatalf("expect the default behavior, got %v %+v", verbose, args)
+	}
+
+	cli.ExplicitBoolValues(true)
+	if err := cli.Run(ctx, "--name", "true", "--verbose", "true"); err != nil {
+		t.Fatal(err)
+	}
+	if !verbose || len(args) != 0 {
+		t.Fatalf("expect verbose and no args, got %v %+v", verbose, args)
+	}
+
+	if err := cli.Run(ctx, "--verbose", "0", "hello", "--verbose", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if verbose || !reflect.DeepEqual(args, []string{"hello", "--verbose", "1"}) {
+		t.Fatalf("expect not verbose with args, got %v %+v", verbose, args)
+	}
+}
+
+func TestFlagReader(t *testing.T) {
+	var name string
+	var count int
+	var ratio float64
+	var loud, missing bool
+	cli := NewCli("Flags", "Test flag reader", "0").
+		StringFlag("name", "Name", "").
+		IntFlag("count", "Count", 1).
+		BoolFlag("loud", "Loud", false).
+		Action(func(ctx context.Context) error {
+			flags := Flags(ctx)
+			name, count, loud = flags.String("name"), flags.Int("count"), flags.Bool("loud")
+			ratio, missing = flags.Float("ratio"), flags.Bool("name")
+			return nil
+		})
+	cli.rootCommand.FloatFlag("ratio", "Ratio", 0.5)
+
+	if err := cli.Run(context.Background(), "--name", "you", "--loud"); err != nil {
+		t.Fatal(err)
+	}
+	if name != "you" || count != 1 || !loud || ratio != 0.5 || missing {
+		t.Fatalf("unexpected values: %q %d %v %v %v", name, count, loud, ratio, missing)
+	}
+}
+
+func TestRawArgs(t *testing.T) {
+	var raw string
+	cli := NewCli("Raw", "Test raw args", "0")
+	cli.NewSubCommand("shell", "Shell").
+		StringFlag("c", "Command", "").
+		Action(func(ctx context.Context) error {
+			raw = RawArgs(ctx)
+			return nil
+		})
+
+	if err := cli.Run(context.Background(), "shell", "-c", "ls -la", "--", "/tmp"); err != nil {
+		t.Fatal(err)
+	}
+	if raw != "-c ls -la -- /tmp" {
+		t.Fatalf("Should be '-c ls -la -- /tmp', got '%s'", raw)
+	}
+}
+
+func TestSession(t *testing.T) {
+	cli := NewCli("Session", "Test session", "0")
+	cli.NewSubCommand("set", "Set").
+		Action(func(ctx context.Context) error {
+			args := OtherArgs(ctx)
+			GetSession(ctx).Set(args[0], args[1])
+			return nil
+		})
+	cli.NewSubCommand("get", "Get").
+		Action(func(ctx context.Context) error {
+			val, _ := GetSession(ctx).Get(OtherArgs(ctx)[0])
+			return Printf(ctx, "%v", val)
+		})
+
+	ctx := WithSession(context.Background(), NewSession())
+	if _, err := cli.RunLine(ctx, false, "set x 1"); err != nil {
+		t.Fatal(err)
+	}
+	ret, err := cli.RunLine(ctx, false, "get x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(ret) != "1" {
+		t.Fatalf("Should be '1', got '%s'", string(ret))
+	}
+}
+
+func TestMessageTranslator(t *testing.T) {
+	cli := NewCli("Translate", "Test translator", "0").
+		MessageTranslator(func(key string, args ...interface{}) string {
+			switch key {
+			case MsgUsageError:
+				return fmt.Sprintf("Fehler: %s", args...)
+			case MsgAvailableCommands:
+				return "Verfügbare Befehle:"
+			}
+			return fmt.Sprintf(key, args...)
+		})
+	cli.NewSubCommand("hello", "Hello")
+
+	ctx := context.Background()
+	err := cli.Run(ctx, "hello", "--xxx")
+	if err == nil || !strings.HasPrefix(err.Error(), "Fehler: ") {
+		t.Fatalf("expect translated error, got %v", err)
+	}
+	if help := cli.HelpString(ctx); !strings.Contains(help, "Verfügbare Befehle:") {
+		t.Fatalf("expect translated header, got %q", help)
+	}
+}
+
+func TestRegisterFactory(t *testing.T) {
+	cli := NewCli("Factory", "Test factory", "0").
+		RegisterFactory(func() []*Command {
+			var cmds []*Command
+			for _, kind := range []string{"user", "group", "role"} {
+				kind := kind
+				cmds = append(cmds, NewCommand(kind, "List "+kind+"s").
+					Action(func(ctx context.Context) error {
+						return Printf(ctx, "listing %ss", kind)
+					}))
+			}
+			return cmds
+		})
+
+	for _, kind := range []string{"user", "group", "role"} {
+		ret, err := cli.RunBuffer(context.Background(), false, kind)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := "listing " + kind + "s"; string(ret) != expected {
+			t.Fatalf("Should be '%s', got '%s'", expected, string(ret))
+		}
+	}
+}
+
+func TestErrorTransform(t *testing.T) {
+	errNotFound := errors.New("not found")
+	cli := NewCli("Transform", "Test error transform", "0").
+		ErrorTransform(func(err error) error {
+			if errors.Is(err, errNotFound) {
+				return fmt.Errorf("404: %w", err)
+			}
+			return err
+		})
+	cli.NewSubCommand("get", "Get").
+		Action(func(ctx context.Context) error {
+			return errNotFound
+		})
+	cli.NewSubCommand("ok", "OK").
+		Action(func(ctx context.Context) error {
+			return nil
+		})
+
+	ctx := context.Background()
+	if err := cli.Run(ctx, "get"); err == nil || err.Error() != "404: not found" || !errors.Is(err, errNotFound) {
+		t.Fatalf("expect transformed error, got %v", err)
+	}
+	if err := cli.Run(ctx, "ok"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTrimOutput(t *testing.T) {
+	cli := NewCli("Trim", "Test trim output", "0").
+		Action(func(ctx context.Context) error {
+			Println(ctx)
+			return PrintJson(ctx, map[string]string{"name": " you "}, "  ")
+		})
+
+	ctx := context.Background()
+	ret, err := cli.RunBuffer(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(ret), "\n") {
+		t.Fatalf("expect untrimmed output, got %q", string(ret))
+	}
+
+	cli.TrimOutput(true)
+	ret, err = cli.RunBuffer(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "{\n  \"name\": \" you \"\n}"; string(ret) != expected {
+		t.Fatalf("Should be %q, got %q", expected, string(ret))
+	}
+
+	var val map[string]string
+	if err := cli.RunUnmarshal(ctx, "", &val); err != nil || val["name"] != " you " {
+		t.Fatalf("expect valid JSON, got %+v %v", val, err)
+	}
+}
+
+func TestFromFlagSet(t *testing.T) {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	fs.String("addr", ":8080", "Address")
+	fs.Int("workers", 4, "Workers")
+
+	var addr string
+	var workers int
+	cli := NewCli("FlagSet", "Test flag set", "0").
+		Commands(FromFlagSet("serve", "Serve", fs, func(ctx context.Context) error {
+			addr = StringFlag(ctx, "addr", "")
+			workers = IntFlag(ctx, "workers", 0)
+			return nil
+		}))
+
+	if err := cli.Run(context.Background(), "serve", "--workers", "8"); err != nil {
+		t.Fatal(err)
+	}
+	if addr != ":8080" || workers != 8 {
+		t.Fatalf("unexpected values: %q %d", addr, workers)
+	}
+}
+
+func TestDefaultSubCommandForwarding(t *testing.T) {
+	var shown []string
+	cli := NewCli("Forward", "Test default subcommand forwarding", "0")
+	remote := cli.NewSubCommand("remote", "Remote")
+	remote.NewSubCommand("add", "Add")
+	remote.DefaultSubCommand(NewCommand("show", "Show").
+		Action(func(ctx context.Context) error {
+			shown = append([]string{}, OtherArgs(ctx)...)
+			return nil
+		}))
+
+	ctx := context.Background()
+	if err := cli.Run(ctx, "remote"); err != nil {
+		t.Fatal(err)
+	}
+	if len(shown) != 0 {
+		t.Fatalf("expect no args, got %+v", shown)
+	}
+
+	shown = nil
+	cli.Run(ctx, "remote", "foo")
+	if shown != nil {
+		t.Fatalf("expect no forwarding, got %+v", shown)
+	}
+
+	remote.DefaultSubCommandForwarding(true)
+	if err := cli.Run(ctx, "remote", "foo"); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(shown, []string{"foo"}) {
+		t.Fatalf("expect forwarded 'foo', got %+v", shown)
+	}
+}
+
+func TestExamples(t *testing.T) {
+	cli := NewCli("Examples", "Test examples", "0")
+	hello := cli.NewSubCommand("hello", "Hello").
+		StringFlag("name", "Name", "").
+		Example("hello", "Greet the world.").
+		Example("hello --name you", "Greet you.")
+
+	help := hello.HelpString(context.Background())
+	expected := "Examples:\n\n" +
+		"   hello\n      Greet the world.\n" +
+		"   hello --name you\n      Greet you.\n\n"
+	if !strings.Contains(help, expected) {
+		t.Fatalf("expect %q in help, got %q", expected, help)
+	}
+}
+
+func TestTransactionWrapper(t *testing.T) {
+	type txKey struct{}
+	var log []string
+	cli := NewCli("Transaction", "Test transactions", "0").
+		TransactionWrapper(func(ctx context.Context) (context.Context, func(error) error, error) {
+			log = append(log, "begin")
+			return context.WithValue(ctx, txKey{}, "tx"), func(err error) error {
+				if err != nil {
+					log = append(log, "rollback")
+				} else {
+					log = append(log, "commit")
+				}
+				return err
+			}, nil
+		})
+	action := func(ctx context.Context) error {
+		log = append(log, fmt.Sprintf("run %v", ctx.Value(txKey{})))
+		if len(OtherArgs(ctx)) > 0 {
+			return errors.New("failed")
+		}
+		return nil
+	}
+	cli.NewSubCommand("update", "Update").Action(action)
+	cli.NewSubCommand("show", "Show").Action(action).NoTransaction()
+
+	ctx := context.Background()
+	if err := cli.Run(ctx, "update"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.Run(ctx, "update", "fail"); err == nil {
+		t.Fatal("Should fail")
+	}
+	if err := cli.Run(ctx, "show"); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"begin", "run tx", "commit", "begin", "run tx", "rollback", "run <nil>"}
+	if !reflect.DeepEqual(log, expected) {
+		t.Fatalf("Not the same: %+v vs. %+v", log, expected)
+	}
+}
+
+// fakePrompter returns the lines in order, after the delay if any, then io.EOF.
+type fakePrompter struct {
+	lines   []string
+	delay   time.Duration
+	history []string
+}
+
+func (p *fakePrompter) Prompt(prompt string) (string, error) {
+	time.Sleep(p.delay)
+	if len(p.lines) == 0 {
+		return "", io.EOF
+	}
+	line := p.lines[0]
+	p.lines = p.lines[1:]
+	return line, nil
+}
+
+func (p *fakePrompter) AppendHistory(item string) {
+	p.history = append(p.history, item)
+}
+
+func TestLoopIdleTimeout(t *testing.T) {
+	cli := NewCli("Loop", "Test loop", "0").
+		Action(func(ctx context.Context) error {
+			return nil
+		})
+
+	p := &fakePrompter{lines: []string{"hello"}, delay: time.Second}
+	done := make(chan struct{})
+	go func() {
+		runLoop(cli, context.Background(), LoopConfig{IdleTimeout: 10 * time.Millisecond}, p)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("loop should exit on idle timeout")
+	}
+}
+
+func TestResolveInput(t *testing.T) {
+	var input string
+	var inputErr error
+	cli := NewCli("Input", "Test resolve input", "0").
+		StringFlag("file", "File", "default.txt").
+		Action(func(ctx context.Context) error {
+			input, inputErr = ResolveInput(ctx, "file")
+			return nil
+		})
+
+	ctx := context.Background()
+	tests := []struct {
+		args  []string
+		input string
+	}{
+		{[]string{"--file", "a.txt", "b.txt"}, "a.txt"},
+		{[]string{"b.txt"}, "b.txt"},
+	}
+	for _, test := range tests {
+		if err := cli.Run(ctx, test.args...); err != nil {
+			t.Fatal(err)
+		}
+		if inputErr != nil || input != test.input {
+			t.Fatalf("expect '%s' for %+v, got '%s' %v", test.input, test.args, input, inputErr)
+		}
+	}
+
+	if err := cli.Run(ctx, "--"); err != nil {
+		t.Fatal(err)
+	}
+	if inputErr == nil {
+		t.Fatalf("expect error with neither flag nor argument, got '%s'", input)
+	}
+}
+
+func TestDefer(t *testing.T) {
+	var log []string
+	cli := NewCli("Defer", "Test defer", "0").
+		Action(func(ctx context.Context) error {
+			Defer(ctx, func() error {
+				log = append(log, "first")
+				return errors.New("first failed")
+			})
+			Defer(ctx, func() error {
+				log = append(log, "second")
+				return errors.New("second failed")
+			})
+			log = append(log, "action")
+			return nil
+		})
+
+	err := cli.Run(context.Background())
+	if expected := []string{"action", "second", "first"}; !reflect.DeepEqual(log, expected) {
+		t.Fatalf("Not the same: %+v vs. %+v", log, expected)
+	}
+	if err == nil || err.Error() != "second failed\nfirst failed" {
+		t.Fatalf("expect joined errors, got %v", err)
+	}
+
+	// The error of the action still matches, also before Go 1.20
+	cli.NewSubCommand("open", "Open").
+		Action(func(ctx context.Context) error {
+			Defer(ctx, func() error { return errors.New("close failed") })
+			_, err := os.Open(filepath.Join(t.TempDir(), "missing"))
+			return fmt.Errorf("open: %w", err)
+		})
+	err = cli.Run(context.Background(), "open")
+	joined, ok := err.(joinedError)
+	if !ok || !joined.Is(fs.ErrNotExist) || !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expect to match fs.ErrNotExist, got %v", err)
+	}
+	var perr *fs.PathError
+	if !joined.As(&perr) || !errors.As(err, &perr) {
+		t.Fatalf("expect a *fs.PathError, got %v", err)
+	}
+}
+
+func TestHelpData(t *testing.T) {
+	cli := NewCli("Data", "Test help data", "1.0")
+	cli.NewSubCommand("hello", "Hello")
+	cli.NewSubCommand("secret", "Secret").Hidden()
+	cli.DefaultCommand(cli.NewSubCommand("bye", "Bye"))
+
+	data := cli.HelpData()
+	if data.Name != "Data" || data.Description != "Test help data" || data.Version != "1.0" {
+		t.Fatalf("unexpected help data: %+v", data)
+	}
+	expected := []HelpCommand{
+		{Name: "hello", Description: "Hello"},
+		{Name: "bye", Description: "Bye", Default: true},
+	}
+	if !reflect.DeepEqual(data.Commands, expected) {
+		t.Fatalf("Not the same: %+v vs. %+v", data.Commands, expected)
+	}
+}
+
+func TestEmit(t *testing.T) {
+	type item struct {
+		Name string `json:"name"`
+	}
+	cli := NewCli("Emit", "Test emit", "0").
+		RegisterEncoder("yaml", func(v interface{}) ([]byte, error) {
+			return []byte(fmt.Sprintf("name: %s\n", v.(item).Name)), nil
+		})
+	cli.NewSubCommand("show", "Show").
+		StringFlag("format", "Format", "").
+		Action(func(ctx context.Context) error {
+			return Emit(ctx, item{"you"})
+		})
+
+	ctx := context.Background()
+	tests := map[string]string{
+		"":     "{\n  \"name\": \"you\"\n}\n",
+		"json": "{\n  \"name\": \"you\"\n}\n",
+		"yaml": "name: you\n",
+	}
+	for format, expected := range tests {
+		ret, err := cli.RunBuffer(ctx, false, "show", "--format", format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(ret) != expected {
+			t.Fatalf("Should be %q for '%s', got %q", expected, format, string(ret))
+		}
+	}
+
+	if _, err := cli.RunBuffer(ctx, false, "show", "--format", "toml"); err == nil {
+		t.Fatal("Should fail with unknown format `toml`")
+	}
+}
+
+func TestCommandTimeout(t *testing.T) {
+	slow := func(ctx context.Context) error {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(50 * time.Millisecond):
+			return nil
+		}
+	}
+	cli := NewCli("Timeout", "Test timeout", "0")
+	cli.NewSubCommand("status", "Status").Timeout(5 * time.Millisecond).Action(slow)
+	cli.NewSubCommand("sync", "Sync").Action(slow)
+
+	ctx := context.Background()
+	if err := cli.Run(ctx, "status"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expect DeadlineExceeded, got %v", err)
+	}
+	if err := cli.Run(ctx, "sync"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIsTerminal(t *testing.T) {
+	ctx := WithStdout(context.Background(), new(bytes.Buffer))
+	if IsTerminal(ctx) {
+		t.Fatal("a buffer is not a terminal")
+	}
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if IsTerminal(WithStdout(ctx, f)) {
+		t.Fatal("a regular file is not a terminal")
+	}
+}
+
+func TestFlagCompletion(t *testing.T) {
+	cli := NewCli("Complete", "Test flag completion", "0")
+	cli.NewSubCommand("checkout", "Checkout").
+		StringFlag("branch", "Branch", "").
+		FlagCompletion("branch", func(ctx context.Context, prefix string) []string {
+			return []string{"main", "master", "dev"}
+		})
+
+	ctx := context.Background()
+	if ret, expected := cli.completeLine(ctx, "checkout --branch ma"), []string{"checkout --branch main", "checkout --branch master"}; !reflect.DeepEqual(ret, expected) {
+		t.Fatalf("Not the same: %+v vs. %+v", ret, expected)
+	}
+	if ret, expected := cli.completeLine(ctx, "checkout --branch=d"), []string{"checkout --branch=dev"}; !reflect.DeepEqual(ret, expected) {
+		t.Fatalf("Not the same: %+v vs. %+v", ret, expected)
+	}
+}
+
+func TestCompletionCommand(t *testing.T) {
+	cli := NewCli("Complete", "Test completion command", "0")
+	cli.CompletionCommand()
+	cli.NewSubCommand("hello", "Hello").
+		StringFlag("name", "Name", "").
+		BoolFlag("loud", "Loud", false).
+		FlagCompletion("name", func(ctx context.Context, prefix string) []string {
+			return []string{"you", "yours", "me"}
+		})
+
+	ctx := context.Background()
+	tests := []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"__complete", "hello", "--n"}, "--name\n"},
+		{[]string{"__complete", "hello", "--name", "y"}, "you\nyours\n"},
+		{[]string{"__complete", "h"}, "hello\n"},
+		{[]string{"__complete", ""}, "hello\n"},
+	}
+	for _, test := range tests {
+		ret, err := cli.RunBuffer(ctx, false, test.args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(ret) != test.expected {
+			t.Fatalf("Should be %q for %+v, got %q", test.expected, test.args, string(ret))
+		}
+	}
+}
+
+func TestResolveNameFromArgv0(t *testing.T) {
+	defer func(fn func() string) { argv0 = fn }(argv0)
+
+	argv0 = func() string { return "/usr/local/bin/mytool" }
+	cli := NewCli("Tool", "Test argv0", "0").ResolveNameFromArgv0(true)
+	cli.NewSubCommand("ls", "List").
+		Action(func(ctx context.Context) error {
+			return Printf(ctx, "listing")
+		})
+
+	ctx := context.Background()
+	if help := cli.HelpString(ctx); !strings.HasPrefix(help, "mytool 0 - Test argv0") {
+		t.Fatalf("expect resolved name in help, got %q", help)
+	}
+	if cli.ResolveNameFromArgv0(false).Name() != "Tool" {
+		t.Fatalf("expect original name, got '%s'", cli.Name())
+	}
+
+	argv0 = func() string { return "/usr/local/bin/ls" }
+	ret, err := cli.ResolveNameFromArgv0(true).RunBuffer(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(ret) != "listing" {
+		t.Fatalf("expect dispatch to 'ls', got '%s'", string(ret))
+	}
+}
+
+// countingWriter counts the writes to it.
+type countingWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(p)
+}
+
+func TestBufferOutput(t *testing.T) {
+	var flushed int
+	cli := NewCli("Buffer", "Test buffered output", "0")
+	cli.NewSubCommand("print", "Print").
+		Action(func(ctx context.Context) error {
+			for i := 0; i < 100; i++ {
+				Printf(ctx, "line %d\n", i)
+			}
+			return nil
+		})
+	cli.NewSubCommand("flush", "Flush").
+		Action(func(ctx context.Context) error {
+			Printf(ctx, "prompt: ")
+			Flush(ctx)
+			flushed = Stdout(ctx).(*bufio.Writer).Buffered()
+			return nil
+		})
+
+	run := func(args ...string) *countingWriter {
+		w := &countingWriter{}
+		if err := cli.Run(WithStdout(context.Background(), w), args...); err != nil {
+			t.Fatal(err)
+		}
+		return w
+	}
+
+	unbuffered := run("print")
+	cli.BufferOutput(true)
+	buffered := run("print")
+	if buffered.String() != unbuffered.String() {
+		t.Fatal("buffered output differs")
+	}
+	if unbuffered.writes != 100 || buffered.writes != 1 {
+		t.Fatalf("expect 100 and 1 writes, got %d and %d", unbuffered.writes, buffered.writes)
+	}
+
+	if w := run("flush"); w.String() != "prompt: " || flushed != 0 {
+		t.Fatalf("expect flushed output, got %q with %d buffered", w.String(), flushed)
+	}
+}
+
+func TestDiscoverExternalCommands(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a shell script")
+	}
+	dir := t.TempDir()
+	script := "#!/bin/sh\necho \"hello $1\"\necho done >&2\n"
+	if err := os.WriteFile(filepath.Join(dir, "myapp-hello"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "myapp-data"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+
+	cli := NewCli("MyApp", "Test external commands", "0").DiscoverExternalCommands("myapp-")
+	if _, ok := cli.rootCommand.subCommandsMap["data"]; ok {
+		t.Fatal("a non-executable should not be registered")
+	}
+
+	ctx := context.Background()
+	if help := cli.HelpString(ctx); !strings.Contains(help, "hello   Run myapp-hello [external]") {
+		t.Fatalf("expect external command in help, got %q", help)
+	}
+
+	var stderr bytes.Buffer
+	ret, err := cli.RunBuffer(WithStderr(ctx, &stderr), false, "hello", "--world")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(ret) != "hello --world\n" {
+		t.Fatalf("Should be 'hello --world\\n', got %q", string(ret))
+	}
+	if stderr.String() != "done\n" {
+		t.Fatalf("expect 'done\\n' in stderr, got %q", stderr.String())
+	}
+}
+
+func TestOutputFileFlag(t *testing.T) {
+	cli := NewCli("Output", "Test output file", "0").OutputFileFlag()
+	cli.NewSubCommand("hello", "Hello").
+		Action(func(ctx context.Context) error {
+			return Println(ctx, "hello")
+		})
+
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "out.txt")
+	ret, err := cli.RunBuffer(ctx, false, "hello", "-o", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ret) != 0 {
+		t.Fatalf("expect no output, got %q", string(ret))
+	}
+	if buf, err := os.ReadFile(path); err != nil || string(buf) != "hello\n" {
+		t.Fatalf("expect 'hello\\n' in file, got %q %v", string(buf), err)
+	}
+
+	if ret, err = cli.RunBuffer(ctx, false, "hello"); err != nil || string(ret) != "hello\n" {
+		t.Fatalf("expect 'hello\\n', got %q %v", string(ret), err)
+	}
+
+	if err = cli.Run(ctx, "hello", "--output", filepath.Join(path, "out.txt")); err == nil {
+		t.Fatal("Should fail to create the file")
+	}
+
+	// A command's own output flag is not the persistent one
+	cli.NewSubCommand("report", "Report").
+		StringFlag("output", "Output format", "text").
+		Action(func(ctx context.Context) error {
+			return Println(ctx, StringFlag(ctx, "output", "text"))
+		})
+	for _, args := range [][]string{{"report"}, {"report", "--output", "text"}} {
+		if ret, err = cli.RunBuffer(ctx, false, args...); err != nil || string(ret) != "text\n" {
+			t.Fatalf("expect 'text\\n' for %v, got %q %v", args, string(ret), err)
+		}
+	}
+}
+
+func TestRunBatch(t *testing.T) {
+	cli := NewCli("Batch", "Test batch", "0")
+	cli.NewSubCommand("echo", "Echo").
+		Action(func(ctx context.Context) error {
+			return Printf(ctx, "%s", strings.Join(OtherArgs(ctx), " "))
+		})
+	cli.NewSubCommand("fail", "Fail").
+		Action(func(ctx context.Context) error {
+			return errors.New("failed")
+		})
+
+	ctx := context.Background()
+	lines := []string{"echo one", "fail", "", "echo three"}
+
+	results, err := cli.RunBatch(ctx, lines, true)
+	if err == nil || len(results) != 2 || string(results[0].Output) != "one" || results[1].Err != err {
+		t.Fatalf("expect stop at 'fail', got %+v %v", results, err)
+	}
+
+	results, err = cli.RunBatch(ctx, lines, false)
+	if err == nil || len(results) != 3 || results[1].Line != "fail" || results[1].Err == nil {
+		t.Fatalf("expect all lines run, got %+v %v", results, err)
+	}
+	if string(results[2].Output) != "three" || results[2].Err != nil {
+		t.Fatalf("expect 'three', got %+v", results[2])
+	}
+}
+
+func TestCatchAll(t *testing.T) {
+	var caught []string
+	cli := NewCli("Proxy", "Test catch-all", "0")
+	cli.NewSubCommand("status", "Status").
+		Action(func(ctx context.Context) error {
+			return Printf(ctx, "status")
+		})
+	cli.rootCommand.CatchAll(NewCommand("proxy", "Proxy").
+		BoolFlag("v", "Verbose", false).
+		Action(func(ctx context.Context) error {
+			caught = OtherArgs(ctx)
+			return nil
+		}))
+
+	ctx := context.Background()
+	if err := cli.Run(ctx, "deploy", "prod", "-v"); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"deploy", "prod", "-v"}; !reflect.DeepEqual(caught, expected) {
+		t.Fatalf("Not the same: %+v vs. %+v", caught, expected)
+	}
+
+	caught = nil
+	if ret, err := cli.RunBuffer(ctx, false, "status"); err != nil || string(ret) != "status" || caught != nil {
+		t.Fatalf("expect 'status' to run, got %q %v %+v", string(ret), err, caught)
+	}
+}
+
+func TestRunUnmarshalBanner(t *testing.T) {
+	cli := NewCli("Banner", "Test banner", "0")
+	cli.NewSubCommand("show", "Show").
+		Action(func(ctx context.Context) error {
+			GetCli(ctx).PrintBanner(ctx)
+			return PrintJson(ctx, map[string]int{"count": 1})
+		})
+	cli.NewSubCommand("text", "Text").
+		Action(func(ctx context.Context) error {
+			return Println(ctx, "not json")
+		})
+
+	stderr := new(bytes.Buffer)
+	ctx := WithStderr(context.Background(), stderr)
+	var val map[string]int
+	if err := cli.RunUnmarshal(ctx, "show", &val); err != nil {
+		t.Fatal(err)
+	}
+	if val["count"] != 1 {
+		t.Fatalf("expect count 1, got %+v", val)
+	}
+	if !strings.HasPrefix(stderr.String(), "Banner 0 - Test banner") {
+		t.Fatalf("expect banner in stderr, got %q", stderr.String())
+	}
+
+	if err := cli.RunUnmarshal(ctx, "text", &val); err == nil || !strings.Contains(err.Error(), "not json") {
+		t.Fatalf("expect error with the output, got %v", err)
+	}
+}
+
+func TestEnvPrefix(t *testing.T) {
+	cli := NewCli("Env", "Test env prefix", "0")
+	cli.NewSubCommand("serve", "Serve").
+		EnvPrefix("MYAPP").
+		StringFlag("listen-addr", "Address", ":80").
+		IntFlag("workers", "Workers", 1).
+		Action(func(ctx context.Context) error {
+			return Printf(ctx, "%s %d %s", StringFlag(ctx, "listen-addr", ""),
+				IntFlag(ctx, "workers", 0), FlagSource(ctx, "workers"))
+		})
+
+	ctx := context.Background()
+	if ret, err := cli.RunBuffer(ctx, false, "serve"); err != nil || string(ret) != ":80 1 default" {
+		t.Fatalf("expect defaults, got %q %v", string(ret), err)
+	}
+
+	t.Setenv("MYAPP_LISTEN_ADDR", ":8080")
+	t.Setenv("MYAPP_WORKERS", "4")
+	if ret, err := cli.RunBuffer(ctx, false, "serve"); err != nil || string(ret) != ":8080 4 env" {
+		t.Fatalf("expect values from env, got %q %v", string(ret), err)
+	}
+	if ret, err := cli.RunBuffer(ctx, false, "serve", "-listen-addr", ":9090", "-workers", "8"); err != nil || string(ret) != ":9090 8 command-line" {
+		t.Fatalf("expect command line to win, got %q %v", string(ret), err)
+	}
+
+	t.Setenv("MYAPP_WORKERS", "many")
+	if _, err := cli.RunBuffer(ctx, false, "serve"); err == nil || !strings.Contains(err.Error(), "MYAPP_WORKERS") {
+		t.Fatalf("expect invalid env error, got %v", err)
+	}
+
+	// Without EnvPrefix or arguments, flags are not parsed, as before
+	verbose := true
+	cli.NewSubCommand("status", "Status").
+		StringFlag("listen-addr", "Address", ":80").
+		BoolFlag("verbose", "Verbose", false, &verbose).
+		Action(func(ctx context.Context) error {
+			return Printf(ctx, "%s", StringFlag(ctx, "listen-addr", "none"))
+		})
+	if ret, err := cli.RunBuffer(ctx, false, "status"); err != nil || string(ret) != "none" || !verbose {
+		t.Fatalf("expect flags not parsed, got %q %v %v", string(ret), verbose, err)
+	}
+}
+
+func TestRunChan(t *testing.T) {
+	type item struct {
+		ID   int
+		Name string
+	}
+
+	cli := NewCli("Stream", "Test stream", "0")
+	cli.NewSubCommand("list", "List").
+		Action(func(ctx context.Context) error {
+			for i, name := range []string{"a", "b", "c"} {
+				select {
+				case Stream(ctx) <- item{i, name}:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			return nil
+		})
+	cli.NewSubCommand("fail", "Fail").
+		Action(func(ctx context.Context) error {
+			Stream(ctx) <- item{0, "x"}
+			return errors.New("failed")
+		})
+
+	items, errc := cli.RunChan(context.Background(), "list")
+	var got []item
+	for it := range items {
+		got = append(got, it.(item))
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if expected := []item{{0, "a"}, {1, "b"}, {2, "c"}}; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Not the same: %+v vs. %+v", got, expected)
+	}
+	if _, ok := <-errc; ok {
+		t.Fatalf("expect error channel closed")
+	}
+
+	items, errc = cli.RunChan(context.Background(), "fail")
+	n := 0
+	for range items {
+		n++
+	}
+	if err := <-errc; n != 1 || err == nil || err.Error() != "failed" {
+		t.Fatalf("expect one item and error, got %d %v", n, err)
+	}
+
+	if Stream(context.Background()) != nil {
+		t.Fatalf("expect no stream outside RunChan")
+	}
+}
+
+func TestNoAction(t *testing.T) {
+	cli := NewCli("Empty", "Test empty command", "0")
+	cli.NewSubCommand("todo", "Not done yet")
+	cli.NewSubCommand("done", "Done").
+		Action(func(ctx context.Context) error {
+			return nil
+		})
+
+	ctx := WithStdout(context.Background(), io.Discard)
+	if err := cli.Run(ctx, "todo"); !errors.Is(err, ErrNoAction) {
+		t.Fatalf("expect ErrNoAction, got %v", err)
+	}
+	if err := cli.Run(ctx, "done"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.HelpIsError(true).Run(ctx); !errors.Is(err, ErrHelp) {
+		t.Fatalf("expect ErrHelp for the root, got %v", err)
+	}
+}
+
+func TestSynopsis(t *testing.T) {
+	cli := NewCli("app", "Test synopsis", "0")
+	if s := cli.Synopsis(); s != "app" {
+		t.Fatalf("expect bare synopsis, got %q", s)
+	}
+
+	cli.BoolFlag("verbose", "Verbose", false)
+	remote := cli.NewSubCommand("remote", "Remote")
+	remote.NewSubCommand("add", "Add").
+		ArgsUsage("<name> <url>").
+		Action(func(ctx context.Context) error {
+			return nil
+		})
+
+	if s := cli.Synopsis(); s != "app [flags] <command>" {
+		t.Fatalf("Not the same: %q", s)
+	}
+	if s := remote.Synopsis(); s != "app remote <command>" {
+		t.Fatalf("Not the same: %q", s)
+	}
+	if s := cli.ChdirFlag().Synopsis(); s != "app [flags] <command>" {
+		t.Fatalf("Not the same: %q", s)
+	}
+	if s := remote.Synopsis(); s != "app remote [flags] <command>" {
+		t.Fatalf("Not the same: %q", s)
+	}
+	if s := remote.subCommandsMap["add"].Synopsis(); s != "app remote add [flags] <name> <url>" {
+		t.Fatalf("Not the same: %q", s)
+	}
+}
+
+func TestRenamedFrom(t *testing.T) {
+	cli := NewCli("Rename", "Test renamed command", "0")
+	cli.NewSubCommand("ls", "List").
+		RenamedFrom("list").
+		Action(func(ctx context.Context) error {
+			return Printf(ctx, "listed")
+		})
+
+	stderr := new(bytes.Buffer)
+	ctx := WithStderr(context.Background(), stderr)
+	if ret, err := cli.RunBuffer(ctx, false, "list"); err != nil || string(ret) != "listed" {
+		t.Fatalf("expect 'ls' to run, got %q %v", string(ret), err)
+	}
+	if warning := `Warning: "list" is deprecated, use "ls"`; !strings.Contains(stderr.String(), warning) {
+		t.Fatalf("expect warning, got %q", stderr.String())
+	}
+
+	stderr.Reset()
+	if ret, err := cli.RunBuffer(ctx, false, "ls"); err != nil || string(ret) != "listed" || stderr.Len() != 0 {
+		t.Fatalf("expect no warning, got %q %v %q", string(ret), err, stderr.String())
+	}
+	if strings.Contains(cli.HelpString(ctx), "list") {
+		t.Fatalf("expect old name hidden from help")
+	}
+}
+
+func TestRunWithSignals(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("cannot send interrupt on windows")
+	}
+
+	cli := NewCli("Signal", "Test signals", "0")
+	cli.NewSubCommand("wait", "Wait").
+		Action(func(ctx context.Context) error {
+			proc, err := os.FindProcess(os.Getpid())
+			if err != nil {
+				return err
+			}
+			if err := proc.Signal(os.Interrupt); err != nil {
+				return err
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(5 * time.Second):
+				return errors.New("not canceled")
+			}
+		})
+
+	if err := cli.RunWithSignals(context.Background(), "wait"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expect context canceled, got %v", err)
+	}
+}
+
+func TestFlagsFromViperSection(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(config, []byte("flags:\n  host: db\n  port: 5432\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	vip, err := NewViperMerged(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cli := NewCli("Section", "Test viper section", "0")
+	cli.NewSubCommand("connect", "Connect").
+		FlagsFromViperSection("flags").
+		StringFlag("host", "Host", "localhost").
+		IntFlag("port", "Port", 80).
+		BoolFlag("tls", "TLS", false).
+		Action(func(ctx context.Context) error {
+			return Printf(ctx, "%s:%d %v %s", StringFlag(ctx, "host", ""), IntFlag(ctx, "port", 0),
+				BoolFlag(ctx, "tls", true), FlagSource(ctx, "port"))
+		})
+
+	ctx := WithViper(context.Background(), vip)
+	if ret, err := cli.RunBuffer(ctx, false, "connect"); err != nil || string(ret) != "db:5432 false viper" {
+		t.Fatalf("expect values from viper, got %q %v", string(ret), err)
+	}
+	if ret, err := cli.RunBuffer(ctx, false, "connect", "-port", "6543"); err != nil || string(ret) != "db:6543 false command-line" {
+		t.Fatalf("expect command line to win, got %q %v", string(ret), err)
+	}
+	if ret, err := cli.RunBuffer(context.Background(), false, "connect"); err != nil || string(ret) != "localhost:80 false default" {
+		t.Fatalf("expect defaults without viper, got %q %v", string(ret), err)
+	}
+}
+
+func TestRunLineSeq(t *testing.T) {
+	vals := map[string]string{}
+	cli := NewCli("Seq", "Test command sequences", "0")
+	cli.NewSubCommand("set", "Set").
+		Action(func(ctx context.Context) error {
+			for _, arg := range OtherArgs(ctx) {
+				if kv := strings.SplitN(arg, "=", 2); len(kv) == 2 {
+					vals[kv[0]] = kv[1]
+				}
+			}
+			return nil
+		})
+	cli.NewSubCommand("show", "Show").
+		Action(func(ctx context.Context) error {
+			return Printf(ctx, "%s", vals[OtherArgs(ctx)[0]])
+		})
+
+	ctx := context.Background()
+	outs, err := cli.RunLineSeq(ctx, false, "set x=1 ; show x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outs) != 2 || string(outs[0]) != "" || string(outs[1]) != "1" {
+		t.Fatalf("unexpected outputs: %q", outs)
+	}
+
+	outs, err = cli.RunLineSeq(ctx, false, `set "y=a; b";show y;`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outs) != 2 || string(outs[1]) != "a; b" {
+		t.Fatalf("unexpected outputs: %q", outs)
+	}
+
+	outs, err = cli.RunLineSeq(ctx, false, "set z=1; show -bad; show z")
+	if err == nil || len(outs) != 2 {
+		t.Fatalf("expect stop at the error, got %q %v", outs, err)
+	}
+	if _, err := cli.RunLineSeq(ctx, false, "show 'x"); err == nil {
+		t.Fatal("Should fail with unterminated quote")
+	}
+}
+
+func TestCommandErrorFunction(t *testing.T) {
+	cli := NewCli("Errors", "Test command error function", "0")
+	cli.NewSubCommand("api", "API").
+		ErrorFunction(func(path string, err error) error {
+			return fmt.Errorf(`{"command": %q, "error": %q}`, path, err.Error())
+		}).
+		Action(func(ctx context.Context) error {
+			return nil
+		})
+	cli.NewSubCommand("plain", "Plain").
+		Action(func(ctx context.Context) error {
+			return nil
+		})
+
+	ctx := WithStdout(context.Background(), io.Discard)
+	err := cli.Run(ctx, "api", "-bad")
+	if err == nil || !strings.HasPrefix(err.Error(), `{"command": "Errors api"`) {
+		t.Fatalf("expect JSON error, got %v", err)
+	}
+	err = cli.Run(ctx, "plain", "-bad")
+	if err == nil || !strings.HasPrefix(err.Error(), "Error: flag provided but not defined") {
+		t.Fatalf("expect default error, got %v", err)
+	}
+}
+
+func TestBindFlags(t *testing.T) {
+	type options struct {
+		Name    string
+		Count   int
+		Ratio   float64 `jcli:"ratio-limit"`
+		Verbose bool
+		Skipped string `jcli:"-"`
+	}
+
+	var opts options
+	cli := NewCli("Bind", "Test binding flags", "0")
+	cli.NewSubCommand("run", "Run").
+		StringFlag("name", "Name", "").
+		IntFlag("count", "Count", 1).
+		FloatFlag("ratio-limit", "Ratio", 0.5).
+		BoolFlag("Verbose", "Verbose", false).
+		StringFlag("skipped", "Skipped", "no").
+		Action(func(ctx context.Context) error {
+			return BindFlags(ctx, &opts)
+		})
+	cli.NewSubCommand("bad", "Bad").
+		IntFlag("name", "Name", 0).
+		Action(func(ctx context.Context) error {
+			return BindFlags(ctx, &opts)
+		})
+
+	ctx := context.Background()
+	if err := cli.Run(ctx, "run", "-name", "x", "-count", "3", "-ratio-limit", "0.8", "-Verbose", "-skipped", "yes"); err != nil {
+		t.Fatal(err)
+	}
+	if expected := (options{"x", 3, 0.8, true, ""}); opts != expected {
+		t.Fatalf("Not the same: %+v vs. %+v", opts, expected)
+	}
+
+	if err := cli.Run(ctx, "bad", "-name", "1"); err == nil {
+		t.Fatal("Should fail with mismatched type")
+	}
+	if err := BindFlags(ctx, opts); err == nil {
+		t.Fatal("Should fail with non-pointer")
+	}
+}
+
+func TestNamedArgs(t *testing.T) {
+	cli := NewCli("app", "Test named arguments", "0")
+	deploy := cli.NewSubCommand("deploy", "Deploy").
+		Arg("env", "staging").
+		Arg("region", "us").
+		Action(func(ctx context.Context) error {
+			return Printf(ctx, "%s %s", StringArg(ctx, "env"), StringArg(ctx, "region"))
+		})
+
+	ctx := context.Background()
+	if ret, err := cli.RunBuffer(ctx, false, "deploy"); err != nil || string(ret) != "staging us" {
+		t.Fatalf("expect defaults, got %q %v", string(ret), err)
+	}
+	if ret, err := cli.RunBuffer(ctx, false, "deploy", "prod"); err != nil || string(ret) != "prod us" {
+		t.Fatalf("expect given env, got %q %v", string(ret), err)
+	}
+	if ret, err := cli.RunBuffer(ctx, false, "deploy", "prod", "eu"); err != nil || string(ret) != "prod eu" {
+		t.Fatalf("expect given args, got %q %v", string(ret), err)
+	}
+	if s := deploy.Synopsis(); s != "app deploy [env=staging] [region=us]" {
+		t.Fatalf("Not the same: %q", s)
+	}
+}
+
+func TestHelpDefaults(t *testing.T) {
+	cli := NewCli("Defaults", "Test help defaults", "0").
+		StringFlag("name", "Name to greet", "world").
+		StringFlag("greeting", "Greeting", "").
+		IntFlag("count", "Count", 0).
+		BoolFlag("loud", "Loud", false)
+
+	help := cli.HelpString(context.Background())
+	if !strings.Contains(help, "  -name string\n    \tName to greet (default: \"world\")\n") {
+		t.Fatalf("expect default of name, got %q", help)
+	}
+	if !strings.Contains(help, "  -count int\n    \tCount (default: 0)\n") {
+		t.Fatalf("expect default of count, got %q", help)
+	}
+	if !strings.Contains(help, "\tGreeting\n") || !strings.Contains(help, "\tLoud\n") {
+		t.Fatalf("expect no defaults for zero string and bool, got %q", help)
+	}
+}
+
+func TestPreRunForCommand(t *testing.T) {
+	var paths []string
+	cli := NewCli("PreRun", "Test pre-run for command", "0").
+		PreRunForCommand(func(ctx context.Context, cli *Cli, path string) error {
+			paths = append(paths, path)
+			if path == "login" {
+				return nil
+			}
+			return errors.New("must be authenticated")
+		})
+	cli.NewSubCommand("login", "Login").
+		Action(func(ctx context.Context) error {
+			return nil
+		})
+	remote := cli.NewSubCommand("remote", "Remote")
+	remote.NewSubCommand("add", "Add").
+		Action(func(ctx context.Context) error {
+			return nil
+		})
+
+	ctx := WithStdout(context.Background(), io.Discard)
+	if err := cli.Run(ctx, "login", "-help"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.Run(ctx, "remote", "add", "origin"); err == nil || err.Error() != "must be authenticated" {
+		t.Fatalf("expect pre-run error, got %v", err)
+	}
+	if expected := []string{"login", "remote add"}; !reflect.DeepEqual(paths, expected) {
+		t.Fatalf("Not the same: %+v vs. %+v", paths, expected)
+	}
+}
+
+func TestLoopRecordReplay(t *testing.T) {
+	cli := NewCli("Record", "Test record and replay", "0")
+	cli.NewSubCommand("echo", "Echo").
+		Action(func(ctx context.Context) error {
+			return Println(ctx, strings.Join(OtherArgs(ctx), " "))
+		})
+
+	record := filepath.Join(t.TempDir(), "session.txt")
+	recorded := new(bytes.Buffer)
+	p := &fakePrompter{lines: []string{"echo hello", "", "echo good bye"}}
+	runLoop(cli, WithStdout(context.Background(), recorded), LoopConfig{RecordPath: record}, p)
+
+	data, err := os.ReadFile(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "echo hello\necho good bye\n" {
+		t.Fatalf("unexpected record: %q", string(data))
+	}
+
+	replayed := new(bytes.Buffer)
+	if err := cli.Replay(WithStdout(context.Background(), replayed), record); err != nil {
+		t.Fatal(err)
+	}
+	if replayed.String() != recorded.String() || replayed.String() != "hello\ngood bye\n" {
+		t.Fatalf("Not the same: %q vs. %q", replayed.String(), recorded.String())
+	}
+}
+
+func TestEchoCommands(t *testing.T) {
+	cli := NewCli("Echo", "Test echo commands", "0").EchoCommands(true)
+	cli.NewSubCommand("hello", "Hello").
+		Action(func(ctx context.Context) error {
+			return Printf(ctx, "hello")
+		})
+
+	stderr := new(bytes.Buffer)
+	ctx := WithStderr(context.Background(), stderr)
+	if _, err := cli.RunBatch(ctx, []string{"hello", "", "hello a"}, true); err != nil {
+		t.Fatal(err)
+	}
+	if stderr.String() != "+ hello\n+ hello a\n" {
+		t.Fatalf("unexpected echo: %q", stderr.String())
+	}
+
+	script := filepath.Join(t.TempDir(), "script.txt")
+	if err := os.WriteFile(script, []byte("hello b\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	stderr.Reset()
+	if err := cli.Replay(WithStdout(ctx, io.Discard), script); err != nil {
+		t.Fatal(err)
+	}
+	if stderr.String() != "+ hello b\n" {
+		t.Fatalf("unexpected echo: %q", stderr.String())
+	}
+}
+
+func TestCommandMeta(t *testing.T) {
+	cli := NewCli("Meta", "Test metadata", "0")
+	deploy := cli.NewSubCommand("deploy", "Deploy").
+		SetMeta("owner", "platform").
+		SetMeta("stability", "beta").
+		StringFlag("env", "Environment", "").
+		Action(func(ctx context.Context) error {
+			return nil
+		})
+
+	if owner, ok := deploy.Meta("owner"); !ok || owner != "platform" {
+		t.Fatalf("expect owner 'platform', got %q %v", owner, ok)
+	}
+	if _, ok := deploy.Meta("since"); ok {
+		t.Fatal("Should not have 'since'")
+	}
+
+	data, err := cli.DescribeJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var desc CommandDescription
+	if err := json.Unmarshal(data, &desc); err != nil {
+		t.Fatal(err)
+	}
+	if len(desc.Commands) != 1 || desc.Commands[0].Path != "Meta deploy" {
+		t.Fatalf("unexpected description: %s", data)
+	}
+	if expected := map[string]string{"owner": "platform", "stability": "beta"}; !reflect.DeepEqual(desc.Commands[0].Meta, expected) {
+		t.Fatalf("Not the same: %+v vs. %+v", desc.Commands[0].Meta, expected)
+	}
+	if !reflect.DeepEqual(desc.Commands[0].Flags, []string{"env"}) {
+		t.Fatalf("unexpected flags: %+v", desc.Commands[0].Flags)
+	}
+}
+
+func TestVerbosityFlag(t *testing.T) {
+	cli := NewCli("Verbose", "Test verbosity flag", "0").VerbosityFlag()
+	cli.NewSubCommand("run", "Run").
+		StringFlag("name", "Name", "").
+		Action(func(ctx context.Context) error {
+			return Printf(ctx, "%d %s %v", Verbosity(ctx), StringFlag(ctx, "name", ""), OtherArgs(ctx))
+		})
+
+	ctx := context.Background()
+	for args, expected := range map[string]string{
+		"run":                     "0  []",
+		"run -v":                  "1  []",
+		"run -vv":                 "2  []",
+		"run -v -verbose -v x":    "3  [x]",
+		"run -vvv -name -vv -v":   "4 -vv []",
+		"run -v=2":                "2  []",
+		"run -- -vv":              "0  [-vv]",
+		"run -name a -vv tail -v": "2 a [tail -v]",
+	} {
+		if ret, err := cli.RunBuffer(ctx, false, strings.Fields(args)...); err != nil || string(ret) != expected {
+			t.Fatalf("%s: expect %q, got %q %v", args, expected, string(ret), err)
+		}
+	}
+}
+
+func TestRunWithFlags(t *testing.T) {
+	var out string
+	cli := NewCli("Seed", "Test seeded flags", "0")
+	cli.NewSubCommand("greet", "Greet").
+		StringFlag("name", "Name", "world").
+		IntFlag("count", "Count", 1).
+		BoolFlag("loud", "Loud", false).
+		Action(func(ctx context.Context) error {
+			out = fmt.Sprintf("%s %d %v %s", StringFlag(ctx, "name", ""), IntFlag(ctx, "count", 0),
+				BoolFlag(ctx, "loud", false), FlagSource(ctx, "name"))
+			return nil
+		})
+
+	ctx := context.Background()
+	seeds := map[string]interface{}{"name": "you", "count": 3, "loud": true}
+	if err := cli.RunWithFlags(ctx, seeds, "greet"); err != nil {
+		t.Fatal(err)
+	}
+	if out != "you 3 true program" {
+		t.Fatalf("unexpected result: %q", out)
+	}
+
+	if err := cli.RunWithFlags(ctx, seeds, "greet", "-name", "me"); err != nil {
+		t.Fatal(err)
+	}
+	if out != "me 3 true command-line" {
+		t.Fatalf("unexpected result: %q", out)
+	}
+
+	if err := cli.RunWithFlags(ctx, map[string]interface{}{"nmae": "x"}, "greet"); err == nil {
+		t.Fatal("Should fail with unknown flag `nmae`")
+	}
+
+	// Seeds win over the environment, as the command line
+	cli.NewSubCommand("serve", "Serve").
+		EnvPrefix("SEED").
+		StringFlag("name", "Name", "world").
+		StringFlag("addr", "Address", ":80").
+		Action(func(ctx context.Context) error {
+			out = fmt.Sprintf("%s %s %s", StringFlag(ctx, "name", ""), FlagSource(ctx, "name"), StringFlag(ctx, "addr", ""))
+			return nil
+		})
+	t.Setenv("SEED_NAME", "fromenv")
+	t.Setenv("SEED_ADDR", ":8080")
+	if err := cli.RunWithFlags(ctx, map[string]interface{}{"name": "seeded"}, "serve"); err != nil {
+		t.Fatal(err)
+	}
+	if out != "seeded program :8080" {
+		t.Fatalf("unexpected result: %q", out)
+	}
+
+	// Seeds apply to the default command run from the root
+	cli.DefaultCommand(cli.rootCommand.subCommandsMap["greet"])
+	if err := cli.RunWithFlags(ctx, map[string]interface{}{"name": "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if out != "b 1 false program" {
+		t.Fatalf("unexpected result: %q", out)
+	}
+}
+
+func TestNewViperToml(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "app.toml"), []byte("[server]\nport = 8080\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	vip, err := NewViper(ViperConfig{ConfigName: "app", ConfigPaths: []string{dir}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port := vip.GetInt("server.port"); port != 8080 {
+		t.Fatalf("expect port 8080, got %d", port)
+	}
+
+	vip, err = NewViper(ViperConfig{ConfigFile: filepath.Join(dir, "app.toml")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port := vip.GetInt("server.port"); port != 8080 {
+		t.Fatalf("expect port 8080 from file, got %d", port)
+	}
+
+	// viper picks app.toml over app.yaml, decoded by its own type
+	if err := os.WriteFile(filepath.Join(dir, "app.yaml"), []byte("server:\n  port: 9090\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	vip, err = NewViper(ViperConfig{ConfigName: "app", ConfigPaths: []string{dir}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port := vip.GetInt("server.port"); port != 8080 {
+		t.Fatalf("expect port 8080 with both files, got %d", port)
+	}
+}
+
+func TestCommandRunString(t *testing.T) {
+	cli := NewCli("Direct", "Test running commands directly", "0")
+	add := cli.NewSubCommand("remote", "Remote").
+		NewSubCommand("add", "Add").
+		StringFlag("name", "Name", "origin").
+		Action(func(ctx context.Context) error {
+			return Printf(ctx, "%s %v %v", StringFlag(ctx, "name", ""), OtherArgs(ctx), GetCli(ctx) != nil)
+		})
+
+	ctx := context.Background()
+	if out, err := add.RunString(ctx, "-name", "upstream", "url"); err != nil || out != "upstream [url] true" {
+		t.Fatalf("unexpected result: %q %v", out, err)
+	}
+
+	detached := NewCommand("alone", "Alone").
+		Action(func(ctx context.Context) error {
+			return nil
+		})
+	if _, err := detached.RunString(ctx); err == nil || !strings.Contains(err.Error(), "not attached") {
+		t.Fatalf("expect not attached error, got %v", err)
+	}
+}
+
+func TestNormalizeFlag(t *testing.T) {
+	cli := NewCli("Normalize", "Test flag normalization", "0")
+	cli.NewSubCommand("set", "Set").
+		StringFlag("env", "Environment", " Staging ").
+		BoolFlag("dry-run", "Dry run", false).
+		NormalizeFlag("env", func(s string) string {
+			return strings.ToLower(strings.TrimSpace(s))
+		}).
+		Action(func(ctx context.Context) error {
+			return Printf(ctx, "%q", StringFlag(ctx, "env", ""))
+		})
+
+	ctx := context.Background()
+	if ret, err := cli.RunBuffer(ctx, false, "set", "-env", "  PROD\t"); err != nil || string(ret) != `"prod"` {
+		t.Fatalf("expect normalized value, got %s %v", ret, err)
+	}
+	if ret, err := cli.RunBuffer(ctx, false, "set", "-dry-run"); err != nil || string(ret) != `"staging"` {
+		t.Fatalf("expect normalized default, got %s %v", ret, err)
+	}
+}
+
+func TestVerboseHelp(t *testing.T) {
+	cli := NewCli("Long", "Test verbose help", "0").VerbosityFlag()
+	cli.NewSubCommand("sync", "Sync files").
+		LongDescription("Sync copies changed files.\nDeleted files are kept.").
+		Action(func(ctx context.Context) error {
+			return nil
+		})
+
+	ctx := context.Background()
+	long := "   sync   Sync files \n          Sync copies changed files.\n          Deleted files are kept.\n"
+	if help := cli.HelpString(ctx); strings.Contains(help, "Sync copies") {
+		t.Fatalf("expect no long description, got %q", help)
+	}
+	if ret, err := cli.RunBuffer(ctx, false, "-help", "-v"); err != nil || !strings.Contains(string(ret), long) {
+		t.Fatalf("expect long description with -v, got %q %v", string(ret), err)
+	}
+	if help := cli.VerboseHelp(true).HelpString(ctx); !strings.Contains(help, long) {
+		t.Fatalf("expect long description, got %q", help)
+	}
+}
+
+func TestHelpIsError(t *testing.T) {
+	cli := NewCli("Help", "Test help is error", "0")
+	cli.NewSubCommand("hello", "Hello").
+		Action(func(ctx context.Context) error {
+			return nil
+		})
+
+	ctx := WithStdout(context.Background(), io.Discard)
+	if err := cli.Run(ctx); err != nil {
+		t.Fatalf("expect no error after help, got %v", err)
+	}
+	if err := cli.HelpIsError(true).Run(ctx); err != ErrHelp {
+		t.Fatalf("expect ErrHelp, got %v", err)
+	}
+	if err := cli.Run(ctx, "hello"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStdinIsPipe(t *testing.T) {
+	cli := NewCli("Pipe", "Test piped stdin", "0")
+	cli.NewSubCommand("process", "Process").
+		Action(func(ctx context.Context) error {
+			if len(OtherArgs(ctx)) > 0 || !StdinIsPipe(ctx) {
+				return Printf(ctx, "no input")
+			}
+			data, err := io.ReadAll(Stdin(ctx))
+			if err != nil {
+				return err
+			}
+			return Printf(ctx, "%s", strings.ToUpper(string(data)))
+		})
+
+	ctx := WithStdin(context.Background(), strings.NewReader("piped"))
+	if ret, err := cli.RunBuffer(ctx, false, "process"); err != nil || string(ret) != "PIPED" {
+		t.Fatalf("expect piped input, got %q %v", string(ret), err)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	w.Close()
+	if !StdinIsPipe(WithStdin(context.Background(), r)) {
+		t.Fatal("Should be a pipe")
+	}
+
+	if runtime.GOOS != "windows" {
+		null, err := os.Open(os.DevNull)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer null.Close()
+		if StdinIsPipe(WithStdin(context.Background(), null)) {
+			t.Fatal("Should not be a pipe for a character device")
+		}
+	}
+}
+
+func TestPrintDiff(t *testing.T) {
+	cli := NewCli("Diff", "Test diff", "0").Color(true)
+	cli.NewSubCommand("diff", "Diff").
+		Action(func(ctx context.Context) error {
+			return PrintDiff(ctx, "a\nb\nc\n", "a\nB\nc\nd\n")
+		})
+
+	ret, err := cli.RunBuffer(context.Background(), false, "diff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := " a\n-b\n+B\n c\n+d\n"; string(ret) != expected {
+		t.Fatalf("Not the same: %q vs. %q", string(ret), expected)
+	}
+	if strings.Contains(string(ret), "\x1b[") {
+		t.Fatalf("expect no color codes when not a terminal, got %q", string(ret))
+	}
+}
+
+func TestMaxConcurrency(t *testing.T) {
+	const limit = 2
+	var mu sync.Mutex
+	var running, peak int
+	release := make(chan struct{})
+
+	cli := NewCli("Limit", "Test concurrency limit", "0")
+	cli.NewSubCommand("heavy", "Heavy").
+		MaxConcurrency(limit, false).
+		Action(func(ctx context.Context) error {
+			mu.Lock()
+			running++
+			if running > peak {
+				peak = running
+			}
+			mu.Unlock()
+			<-release
+			mu.Lock()
+			running--
+			mu.Unlock()
+			return nil
+		})
+	fast := cli.NewSubCommand("fast", "Fast").
+		MaxConcurrency(1, true).
+		Action(func(ctx context.Context) error {
+			<-release
+			return nil
+		})
+
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	errs := make(chan error, limit+2)
+	for i := 0; i < limit+2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- cli.Run(ctx, "heavy")
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	if running != limit {
+		t.Errorf("expect %d running, got %d", limit, running)
+	}
+	mu.Unlock()
+
+	// A fail-fast command at its limit fails right away
+	fast.semaphore <- struct{}{}
+	if err := cli.Run(ctx, "fast"); !errors.Is(err, ErrConcurrencyLimit) {
+		t.Errorf("expect ErrConcurrencyLimit, got %v", err)
+	}
+	<-fast.semaphore
+
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if peak != limit {
+		t.Fatalf("expect peak %d, got %d", limit, peak)
+	}
+}
+
+func TestAmbiguousFlag(t *testing.T) {
+	cli := NewCli("Ambiguous", "Test ambiguous flags", "0")
+	cli.NewSubCommand("run", "Run").
+		BoolFlag("verbose", "Verbose", false).
+		StringFlag("version", "Version", "").
+		Action(func(ctx context.Context) error {
+			return nil
+		})
+
+	var out bytes.Buffer
+	ctx := WithStdout(context.Background(), &out)
+	err := cli.Run(ctx, "run", "--ver")
+	if err == nil || !strings.Contains(err.Error(), "ambiguous flag --ver: matches --verbose, --version") {
+		t.Fatalf("expect ambiguity error, got %v", err)
+	}
+	if strings.Contains(out.String(), "not defined") {
+		t.Fatalf("expect no undefined flag output, got %q", out.String())
+	}
+	err = cli.Run(ctx, "run", "-version", "-ver", "-x")
+	if err == nil || !strings.Contains(err.Error(), "flag provided but not defined: -x") {
+		t.Fatalf("expect undefined flag error, got %v", err)
+	}
+	err = cli.Run(ctx, "run", "-verb")
+	if err == nil || !strings.Contains(err.Error(), "flag provided but not defined: -verb") {
+		t.Fatalf("expect undefined flag error, got %v", err)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	var snap CommandSnapshot
+	cli := NewCli("Snap", "Test snapshot", "0")
+	cli.NewSubCommand("copy", "Copy").
+		StringFlag("mode", "Mode", "fast").
+		IntFlag("retries", "Retries", 0).
+		BoolFlag("force", "Force", false).
+		Action(func(ctx context.Context) error {
+			snap = Snapshot(ctx)
+			return nil
+		})
+
+	if err := cli.Run(context.Background(), "copy", "-retries", "3", "-force", "a b", "c"); err != nil {
+		t.Fatal(err)
+	}
+	expected := CommandSnapshot{
+		Path:  "Snap copy",
+		Flags: map[string]string{"retries": "3", "force": "true"},
+		Args:  []string{"a b", "c"},
+	}
+	if !reflect.DeepEqual(snap, expected) {
+		t.Fatalf("Not the same: %+v vs. %+v", snap, expected)
+	}
+	if s := snap.String(); s != `Snap copy -force=true -retries=3 -- "a b" c` {
+		t.Fatalf("unexpected string: %s", s)
+	}
+
+	data, err := json.Marshal(snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded CommandSnapshot
+	if err := json.Unmarshal(data, &decoded); err != nil || !reflect.DeepEqual(decoded, expected) {
+		t.Fatalf("unexpected JSON: %s %v", data, err)
+	}
+}
+
+func TestDefaultCommandWithFlags(t *testing.T) {
+	cli := NewCli("FlagOnly", "Test default command with flags", "0")
+	show := cli.NewSubCommand("show", "Show").
+		StringFlag("fmt", "Format", "text").
+		Action(func(ctx context.Context) error {
+			return Printf(ctx, "show %s", StringFlag(ctx, "fmt", "text"))
+		})
+	cli.DefaultCommand(show)
+
+	ctx := context.Background()
+	if ret, err := cli.RunBuffer(ctx, false); err != nil || string(ret) != "show text" {
+		t.Fatalf("expect default command, got %q %v", string(ret), err)
+	}
+	if ret, err := cli.RunBuffer(ctx, false, "--fmt", "json"); err != nil || string(ret) != "show json" {
+		t.Fatalf("expect default command with flags, got %q %v", string(ret), err)
+	}
+	if ret, err := cli.RunBuffer(ctx, false, "--help"); err != nil || !strings.Contains(string(ret), "Available commands:") {
+		t.Fatalf("expect root help, got %q %v", string(ret), err)
+	}
+
+	// Root flags are parsed by the root, with their values for the default command
+	root := NewCli("RootFlags", "Test default command with root flags", "0").
+		StringFlag("fmt", "Format", "text")
+	root.DefaultCommand(root.NewSubCommand("show", "Show").
+		IntFlag("limit", "Limit", 10).
+		Action(func(ctx context.Context) error {
+			return Printf(ctx, "show %s", StringFlag(ctx, "fmt", "text"))
+		}))
+	if ret, err := root.RunBuffer(ctx, false, "--fmt", "json"); err != nil || string(ret) != "show json" {
+		t.Fatalf("expect default command with root flags, got %q %v", string(ret), err)
+	}
+	if ret, err := root.RunBuffer(ctx, false, "--fmt", "json", "extra"); err != nil || !strings.Contains(string(ret), "Available commands:") {
+		t.Fatalf("expect root help, got %q %v", string(ret), err)
+	}
+
+	// Root flags and flags of the default command cannot be mixed
+	for _, args := range [][]string{{"--fmt", "json", "--limit", "3"}, {"--limit", "3", "--fmt", "json"}} {
+		if _, err := root.RunBuffer(ctx, false, args...); err == nil || !strings.Contains(err.Error(), "not defined: -limit") {
+			t.Fatalf("expect undefined flag for %v, got %v", args, err)
+		}
+	}
+}
+
+func TestFlagGroup(t *testing.T) {
+	paging := NewFlagGroup("Pagination").
+		IntFlag("limit", "Maximum number of items", 10).
+		IntFlag("offset", "Number of items to skip", 0)
+
+	cli := NewCli("Group", "Test flag groups", "0")
+	users := cli.NewSubCommand("users", "Users").
+		StringFlag("role", "Role", "").
+		AddFlagGroup(paging).
+		Action(func(ctx context.Context) error {
+			return Printf(ctx, "users %d %d", IntFlag(ctx, "limit", 0), IntFlag(ctx, "offset", 0))
+		})
+	cli.NewSubCommand("groups", "Groups").
+		AddFlagGroup(paging).
+		Action(func(ctx context.Context) error {
+			return Printf(ctx, "groups %d %d", IntFlag(ctx, "limit", 0), IntFlag(ctx, "offset", 0))
+		})
+
+	ctx := context.Background()
+	if ret, err := cli.RunBuffer(ctx, false, "users", "-limit", "5", "-offset", "20"); err != nil || string(ret) != "users 5 20" {
+		t.Fatalf("unexpected result: %q %v", string(ret), err)
+	}
+	if ret, err := cli.RunBuffer(ctx, false, "groups", "-offset", "3"); err != nil || string(ret) != "groups 10 3" {
+		t.Fatalf("unexpected result: %q %v", string(ret), err)
+	}
+
+	help := users.HelpString(ctx)
+	i, j := strings.Index(help, "Flags:"), strings.Index(help, "Pagination flags:")
+	if i < 0 || j < i || strings.Contains(help[i:j], "-limit") || !strings.Contains(help[j:], "-limit int") ||
+		!strings.Contains(help[i:j], "-role") || strings.Contains(help[j:], "-help") {
+		t.Fatalf("expect a pagination section, got %q", help)
+	}
+}
+
+func TestNegotiateFormat(t *testing.T) {
+	cli := NewCli("Accept", "Test format negotiation", "0").
+		RegisterEncoder("yaml", func(v interface{}) ([]byte, error) {
+			m := v.(map[string]int)
+			return []byte(fmt.Sprintf("count: %d\n", m["count"])), nil
+		})
+	cli.NewSubCommand("show", "Show").
+		StringFlag("format", "Format", "").
+		Action(func(ctx context.Context) error {
+			return Emit(ctx, map[string]int{"count": 1})
+		})
+
+	ctx := context.Background()
+	for accept, expected := range map[string]string{
+		"":                   "json",
+		"application/yaml":   "yaml",
+		"application/x-yaml": "yaml",
+		"text/html, */*":     "json",
+		"application/json;q=0.9, application/yaml": "yaml",
+		"application/json, application/yaml;q=0.5": "json",
+	} {
+		if format := cli.NegotiateFormat(WithAccept(ctx, accept)); format != expected {
+			t.Fatalf("%q: expect %s, got %s", accept, expected, format)
+		}
+	}
+
+	ctx = WithAccept(ctx, "application/yaml")
+	if ret, err := cli.RunBuffer(ctx, false, "show"); err != nil || string(ret) != "count: 1\n" {
+		t.Fatalf("expect YAML, got %q %v", string(ret), err)
+	}
+	if ret, err := cli.RunBuffer(ctx, false, "show", "-format", "json"); err != nil || string(ret) != "{\n  \"count\": 1\n}\n" {
+		t.Fatalf("expect JSON for the flag, got %q %v", string(ret), err)
+	}
+}
+
+func TestDisableHelpFlag(t *testing.T) {
+	cli := NewCli("NoHelp", "Test disabled help flag", "0")
+	cli.NewSubCommand("tool", "Tool").
+		DisableHelpFlag().
+		StringFlag("dir", "Directory", "").
+		Action(func(ctx context.Context) error {
+			return Printf(ctx, "%s %v", StringFlag(ctx, "dir", ""), OtherArgs(ctx))
+		})
+	cli.NewSubCommand("other", "Other").
+		Action(func(ctx context.Context) error {
+			return Printf(ctx, "other")
+		})
+
+	ctx := context.Background()
+	if ret, err := cli.RunBuffer(ctx, false, "tool", "-dir", "x", "--help", "-v"); err != nil || string(ret) != "x [--help -v]" {
+		t.Fatalf("expect --help passed on, got %q %v", string(ret), err)
+	}
+	if ret, err := cli.RunBuffer(ctx, false, "other", "--help"); err != nil || !strings.Contains(string(ret), "NoHelp other - Other") {
+		t.Fatalf("expect help of other, got %q %v", string(ret), err)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	cli := NewCli("Metrics", "Test metrics", "0")
+	cli.NewSubCommand("work", "Work").
+		Action(func(ctx context.Context) error {
+			time.Sleep(time.Millisecond)
+			return nil
+		})
+
+	ctx := context.Background()
+	if err := cli.Run(ctx, "work"); err != nil {
+		t.Fatal(err)
+	}
+	if m := cli.Metrics(); m != nil {
+		t.Fatalf("expect no metrics by default, got %+v", m)
+	}
+
+	cli.CollectMetrics(true)
+	for i := 0; i < 5; i++ {
+		if err := cli.Run(ctx, "work"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m, ok := cli.Metrics()["Metrics work"]
+	if !ok || m.Count != 5 || m.P50 < time.Millisecond || m.P95 < m.P50 {
+		t.Fatalf("unexpected metrics: %+v", cli.Metrics())
+	}
+}
+
+func TestShellEscape(t *testing.T) {
+	for _, c := range []struct {
+		line, escape, cmd string
+		ok                bool
+	}{
+		{"!ls -la", "!", "ls -la", true},
+		{"  ! echo hi ", "!", "echo hi", true},
+		{"ls -la", "!", "", false},
+		{"!ls", "", "", false},
+		{"sh: pwd", "sh:", "pwd", true},
+	} {
+		if cmd, ok := shellCommand(c.line, c.escape); cmd != c.cmd || ok != c.ok {
+			t.Fatalf("%q: expect %q %v, got %q %v", c.line, c.cmd, c.ok, cmd, ok)
+		}
+	}
+
+	if runtime.GOOS == "windows" {
+		return
+	}
+	cli := NewCli("Shell", "Test shell escape", "0").
+		Action(func(ctx context.Context) error {
+			return Printf(ctx, "command\n")
+		})
+	out := new(bytes.Buffer)
+	p := &fakePrompter{lines: []string{"!echo from shell", "run"}}
+	runLoop(cli, WithStdout(context.Background(), out), LoopConfig{ShellEscape: "!"}, p)
+	if out.String() != "from shell\ncommand\n" {
+		t.Fatalf("unexpected output: %q", out.String())
+	}
+}
+
+func TestMount(t *testing.T) {
+	users := NewCli("users", "Manage users", "0")
+	users.NewSubCommand("add", "Add a user").
+		StringFlag("role", "Role", "member").
+		Action(func(ctx context.Context) error {
+			return Printf(ctx, "add %s %s %s", OtherArgs(ctx)[0], StringFlag(ctx, "role", ""), GetCli(ctx).Name())
+		})
+	list := users.NewSubCommand("list", "List users").
+		Action(func(ctx context.Context) error {
+			return Printf(ctx, "list")
+		})
+	users.DefaultCommand(list)
+
+	app := NewCli("app", "Test mount", "1").Mount("user", users)
+
+	ctx := context.Background()
+	if ret, err := app.RunBuffer(ctx, false, "user", "add", "-role", "admin", "bob"); err != nil || string(ret) != "add bob admin app" {
+		t.Fatalf("unexpected result: %q %v", string(ret), err)
+	}
+	if ret, err := app.RunBuffer(ctx, false, "user"); err != nil || string(ret) != "list" {
+		t.Fatalf("expect default command of the mounted cli, got %q %v", string(ret), err)
+	}
+	help := app.HelpString(ctx)
+	if !strings.Contains(help, "user   Manage users") {
+		t.Fatalf("expect mounted command in help, got %q", help)
+	}
+	if help := list.parent.HelpString(ctx); !strings.Contains(help, "app user - Manage users") {
+		t.Fatalf("expect mounted help, got %q", help)
+	}
+}
+
+func TestEmitEvent(t *testing.T) {
+	cli := NewCli("Events", "Test events", "0")
+	cli.NewSubCommand("copy", "Copy").
+		Action(func(ctx context.Context) error {
+			for i := 1; i <= 2; i++ {
+				if err := EmitEvent(ctx, Event{"copied", i}); err != nil {
+					return err
+				}
+			}
+			return Printf(ctx, "done")
+		})
+
+	events := make(chan Event)
+	var got []Event
+	done := make(chan struct{})
+	go func() {
+		for event := range events {
+			got = append(got, event)
+		}
+		close(done)
+	}()
+
+	ret, err := cli.RunBuffer(WithEvents(context.Background(), events), false, "copy")
+	close(events)
+	<-done
+	if err != nil || string(ret) != "done" {
+		t.Fatalf("unexpected result: %q %v", string(ret), err)
+	}
+	if expected := []Event{{"copied", 1}, {"copied", 2}}; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Not the same: %+v vs. %+v", got, expected)
+	}
+
+	if ret, err := cli.RunBuffer(context.Background(), false, "copy"); err != nil || string(ret) != "done" {
+		t.Fatalf("expect events dropped without a channel, got %q %v", string(ret), err)
+	}
+}
+
+func TestFlagsFile(t *testing.T) {
+	cli := NewCli("FlagsFile", "Test flags file", "0").FlagsFile()
+	cli.NewSubCommand("run", "Run").
+		StringFlag("name", "Name", "").
+		IntFlag("count", "Count", 1).
+		BoolFlag("loud", "Loud", false).
+		Action(func(ctx context.Context) error {
+			return Printf(ctx, "%s %d %v %v", StringFlag(ctx, "name", ""), IntFlag(ctx, "count", 0),
+				BoolFlag(ctx, "loud", false), OtherArgs(ctx))
+		})
+
+	conf := filepath.Join(t.TempDir(), "run.conf")
+	content := "# saved flags\n--name John Doe\n\n--count 3\n--loud\n"
+	if err := os.WriteFile(conf, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if ret, err := cli.RunBuffer(ctx, false, "run", "--flags-file", conf, "x"); err != nil || string(ret) != "John Doe 3 true [x]" {
+		t.Fatalf("expect flags from file, got %q %v", string(ret), err)
+	}
+	if ret, err := cli.RunBuffer(ctx, false, "run", "--flags-file="+conf, "-count", "5"); err != nil || string(ret) != "John Doe 5 true []" {
+		t.Fatalf("expect command line to win, got %q %v", string(ret), err)
+	}
+	if ret, err := cli.RunBuffer(ctx, false, "run", "-name", "cli", "--flags-file", conf); err != nil || string(ret) != "cli 3 true []" {
+		t.Fatalf("expect command line before the file to win, got %q %v", string(ret), err)
+	}
+	if ret, err := cli.RunBuffer(ctx, false, "run", "x", "--flags-file", conf); err != nil || string(ret) != " 1 false [x --flags-file "+conf+"]" {
+		t.Fatalf("expect the file kept as an argument, got %q %v", string(ret), err)
+	}
+	if _, err := cli.RunBuffer(ctx, false, "run", "--flags-file", conf+".missing"); err == nil {
+		t.Fatal("Should fail with missing file")
+	}
+}
+
+func TestActionFunc(t *testing.T) {
+	cli := NewCli("ActionFunc", "Test action func", "0")
+	greet := cli.NewSubCommand("greet", "Greet").
+		StringFlag("name", "Name", "world").
+		Action(func(ctx context.Context) error {
+			return Printf(ctx, "Hello %s", StringFlag(ctx, "name", ""))
+		})
+
+	if cli.NewSubCommand("empty", "Empty").ActionFunc() != nil {
+		t.Fatal("Should have no action")
+	}
+
+	buf := new(bytes.Buffer)
+	ctx, err := greet.flags.parseFlags(WithStdout(context.Background(), buf), "greet", []string{"-name", "you"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := greet.ActionFunc()(ctx); err != nil || buf.String() != "Hello you" {
+		t.Fatalf("unexpected result: %q %v", buf.String(), err)
+	}
+}
+
+func TestFlagTemplates(t *testing.T) {
+	cli := NewCli("Templates", "Test flag templates", "0").FlagTemplates(true)
+	cli.NewSubCommand("connect", "Connect").
+		StringFlag("host", "Host", "localhost").
+		IntFlag("port", "Port", 80).
+		StringFlag("url", "URL", "http://{{.host}}:{{.port}}").
+		StringFlag("base", "Base", "").
+		Action(func(ctx context.Context) error {
+			return Printf(ctx, "%s %s", StringFlag(ctx, "url", ""), StringFlag(ctx, "base", ""))
+		})
+
+	ctx := WithStdout(context.Background(), io.Discard)
+	if ret, err := cli.RunBuffer(ctx, false, "connect", "-host", "db", "-port", "5432"); err != nil || string(ret) != "http://db:5432 " {
+		t.Fatalf("unexpected result: %q %v", string(ret), err)
+	}
+	if ret, err := cli.RunBuffer(ctx, false, "connect", "-url", "https://{{.host}}:{{.port}}", "-base", "{{.url}}/api"); err != nil || string(ret) != "https://localhost:80 https://localhost:80/api" {
+		t.Fatalf("unexpected result: %q %v", string(ret), err)
+	}
+	if _, err := cli.RunBuffer(ctx, false, "connect", "-host", "{{.base}}", "-base", "{{.host}}"); err == nil || !strings.Contains(err.Error(), "Cyclic") {
+		t.Fatalf("expect cyclic error, got %v", err)
+	}
+	if _, err := cli.RunBuffer(ctx, false, "connect", "-base", "x{{.base}}"); err == nil || !strings.Contains(err.Error(), "Cyclic") {
+		t.Fatalf("expect cyclic error, got %v", err)
+	}
+	if _, err := cli.RunBuffer(ctx, false, "connect", "-base", "{{.nope}}"); err == nil {
+		t.Fatal("Should fail with unknown flag in template")
+	}
+}
+
+func TestGenSimpleCompletion(t *testing.T) {
+	cli := NewCli("Simple", "Test simple completion", "0")
+	cli.NewSubCommand("build", "Build").NewSubCommand("all", "All")
+	cli.NewSubCommand("test", "Test")
+	cli.NewSubCommand("secret", "Secret").Hidden()
+	cli.CompletionCommand()
+
+	buf := new(bytes.Buffer)
+	if err := cli.GenSimpleCompletion(context.Background(), buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "build test\n" {
+		t.Fatalf("unexpected names: %q", buf.String())
+	}
+}
+
+func TestStdinCommand(t *testing.T) {
+	cli := NewCli("StdinCmd", "Test stdin command", "0")
+	process := cli.NewSubCommand("process", "Process").
+		Action(func(ctx context.Context) error {
+			data, err := io.ReadAll(Stdin(ctx))
+			if err != nil {
+				return err
+			}
+			return Printf(ctx, "processed %s", data)
+		})
+	status := cli.NewSubCommand("status", "Status").
+		Action(func(ctx context.Context) error {
+			return Printf(ctx, "status")
+		})
+	cli.StdinCommand(process).DefaultCommand(status)
+
+	ctx := WithStdin(context.Background(), strings.NewReader("data"))
+	if ret, err := cli.RunBuffer(ctx, false); err != nil || string(ret) != "processed data" {
+		t.Fatalf("expect stdin command, got %q %v", string(ret), err)
+	}
+	if ret, err := cli.RunBuffer(ctx, false, "status"); err != nil || string(ret) != "status" {
+		t.Fatalf("expect status, got %q %v", string(ret), err)
+	}
+
+	if runtime.GOOS != "windows" {
+		null, err := os.Open(os.DevNull)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer null.Close()
+		if ret, err := cli.RunBuffer(WithStdin(context.Background(), null), false); err != nil || string(ret) != "status" {
+			t.Fatalf("expect default command without piped input, got %q %v", string(ret), err)
+		}
+	}
+}
+
+func TestViperNamespace(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "config.yaml")
+	content := "timeout: 1\nbuild:\n  timeout: 10\n  target: bin\ndeploy:\n  timeout: 20\n"
+	if err := os.WriteFile(config, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	vip, err := NewViperMerged(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	show := func(ctx context.Context) error {
+		return Printf(ctx, "%d %s", GetIntOrViper(ctx, "timeout", "timeout"), StringFlagOrViper(ctx, "target", "target"))
+	}
+	cli := NewCli("Namespace", "Test viper namespace", "0")
+	cli.NewSubCommand("build", "Build").ViperNamespace("build").StringFlag("target", "Target", "").Action(show)
+	cli.NewSubCommand("deploy", "Deploy").ViperNamespace("deploy").StringFlag("target", "Target", "").Action(show)
+	cli.NewSubCommand("plain", "Plain").StringFlag("target", "Target", "").Action(show)
+
+	ctx := WithViper(context.Background(), vip)
+	for cmd, expected := range map[string]string{"build": "10 bin", "deploy": "20 ", "plain": "1 "} {
+		if ret, err := cli.RunBuffer(ctx, false, cmd); err != nil || string(ret) != expected {
+			t.Fatalf("%s: expect %q, got %q %v", cmd, expected, string(ret), err)
+		}
+	}
+	if ret, err := cli.RunBuffer(ctx, false, "build", "-target", "out"); err != nil || string(ret) != "10 out" {
+		t.Fatalf("expect flag to win, got %q %v", string(ret), err)
+	}
+}
+
+func TestHelpTemplate(t *testing.T) {
+	cli := NewCli("brand", "Test help template", "2.0")
+	err := cli.HelpTemplate(`{{.Path}} v{{.Version}}: {{.Description}}
+{{range .Commands}}* {{.Name}}
+{{end}}{{range .Flags}}--{{.Name}}={{.Default}} {{.Description}}
+{{end}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deploy := cli.NewSubCommand("deploy", "Deploy").
+		StringFlag("env", "Environment", "staging")
+	deploy.NewSubCommand("app", "App")
+	deploy.NewSubCommand("db", "DB")
+
+	expected := "brand deploy v2.0: Deploy\n* app\n* db\n--env=staging Environment\n"
+	if help := deploy.HelpString(context.Background()); help != expected {
+		t.Fatalf("Not the same: %q vs. %q", help, expected)
+	}
+	if ret, err := cli.RunBuffer(context.Background(), false, "deploy", "-help"); err != nil || string(ret) != expected {
+		t.Fatalf("expect templated help, got %q %v", string(ret), err)
+	}
+
+	if err := cli.HelpTemplate("{{.Path"); err == nil {
+		t.Fatal("Should fail with invalid template")
+	}
+	if help := deploy.HelpString(context.Background()); help != expected {
+		t.Fatalf("expect the template kept, got %q", help)
+	}
+}
+
+func TestByteSizeFlag(t *testing.T) {
+	cli := NewCli("Size", "Test byte size flags", "0")
+	cli.NewSubCommand("upload", "Upload").
+		ByteSizeFlag("max-size", "Maximum size", 1024).
+		Action(func(ctx context.Context) error {
+			return Printf(ctx, "%d", ByteSizeFlag(ctx, "max-size", 1024))
+		})
+
+	ctx := WithStdout(context.Background(), io.Discard)
+	for size, expected := range map[string]string{
+		"":      "1024",
+		"10MB":  "10000000",
+		"1MiB":  "1048576",
+		"512":   "512",
+		"2 kb":  "2000",
+		"1.5GB": "1500000000",
+		"3GiB":  "3221225472",
+	} {
+		args := []string{"upload"}
+		if size != "" {
+			args = append(args, "-max-size", size)
+		}
+		if ret, err := cli.RunBuffer(ctx, false, args...); err != nil || string(ret) != expected {
+			t.Fatalf("%q: expect %s, got %q %v", size, expected, string(ret), err)
+		}
+	}
+
+	for _, size := range []string{"10XB", "MB", "-1KB"} {
+		if _, err := cli.RunBuffer(ctx, false, "upload", "-max-size", size); err == nil || !strings.Contains(err.Error(), "byte size") {
+			t.Fatalf("%q: expect invalid byte size, got %v", size, err)
+		}
+	}
+}
+
+type upperWriter struct{ w io.Writer }
+
+func (u upperWriter) Write(p []byte) (int, error) {
+	return u.w.Write(bytes.ToUpper(p))
+}
+
+func TestStdoutWrapper(t *testing.T) {
+	cli := NewCli("Wrap", "Test stdout wrapper", "0").
+		StdoutWrapper(func(w io.Writer) io.Writer { return upperWriter{w} })
+	cli.NewSubCommand("hello", "Say hello").
+		Action(func(ctx context.Context) error {
+			return Printf(ctx, "hello %s\n", "world")
+		})
+
+	out, err := cli.RunBuffer(context.Background(), false, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "HELLO WORLD\n" {
+		t.Fatalf("Unexpected output: %q", out)
+	}
+}
+
+func TestShowHelp(t *testing.T) {
+	cli := NewCli("Show", "Test showing help", "0")
+	cli.NewSubCommand("greet", "Greet someone").
+		Action(func(ctx context.Context) error {
+			if len(OtherArgs(ctx)) == 0 {
+				return ErrShowHelp
+			}
+			return Printf(ctx, "hello %s\n", OtherArgs(ctx)[0])
+		})
+
+	var buf bytes.Buffer
+	ctx := WithStdout(context.Background(), &buf)
+	if err := cli.Run(ctx, "greet"); err != nil {
+		t.Fatalf("expect nil, got %v", err)
+	}
+	if !strings.Contains(buf.String(), "Greet someone") {
+		t.Fatalf("expect help, got %q", buf.String())
+	}
+
+	buf.Reset()
+	if err := cli.Run(ctx, "greet", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "hello bob\n" {
+		t.Fatalf("Unexpected output: %q", buf.String())
+	}
+
+	// Cleanup errors are still returned
+	cli.NewSubCommand("clean", "Clean up").
+		Action(func(ctx context.Context) error {
+			Defer(ctx, func() error { return errors.New("cleanup failed") })
+			return ErrShowHelp
+		})
+	buf.Reset()
+	err := cli.Run(ctx, "clean")
+	if err == nil || err.Error() != "cleanup failed" || errors.Is(err, ErrShowHelp) {
+		t.Fatalf("expect the cleanup error only, got %v", err)
+	}
+	if !strings.Contains(buf.String(), "Clean up") {
+		t.Fatalf("expect help, got %q", buf.String())
+	}
+}
+
+func TestPreflightForTag(t *testing.T) {
+	errOffline := errors.New("network unavailable")
+	var ran []string
+	cli := NewCli("Preflight", "Test preflight checks", "0").
+		PreflightForTag("needs-network", func(ctx context.Context) error {
+			return errOffline
+		})
+	cli.NewSubCommand("fetch", "Fetch remotely").
+		Tag("needs-network").
+		Action(func(ctx context.Context) error {
+			ran = append(ran, "fetch")
+			return nil
+		})
+	cli.NewSubCommand("list", "List locally").
+		Action(func(ctx context.Context) error {
+			ran = append(ran, "list")
+			return nil
+		})
+
+	ctx := context.Background()
+	if err := cli.Run(ctx, "fetch"); err != errOffline {
+		t.Fatalf("expect the check error, got %v", err)
+	}
+	if err := cli.Run(ctx, "list"); err != nil {
+		t.Fatal(err)
+	}
+	if len(ran) != 1 || ran[0] != "list" {
+		t.Fatalf("Unexpected actions run: %v", ran)
+	}
+}
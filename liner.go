@@ -4,15 +4,56 @@ package jcli
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"os/exec"
 	"strings"
+	"time"
 
 	"github.com/peterh/liner"
 )
 
+// LoopConfig configures RunLoopConfig.
+type LoopConfig struct {
+	Prompt      string
+	HistoryPath string
+
+	// IdleTimeout ends the loop when no line is entered for this long; zero
+	// for no timeout.
+	IdleTimeout time.Duration
+
+	// RecordPath is the file each line run is appended to, to be replayed with
+	// Cli.Replay; empty for none.
+	RecordPath string
+
+	// ShellEscape is the prefix of lines run by the shell with 'sh -c', such
+	// as "!" for "!ls -la", rather than as commands; empty for none. These
+	// lines are not recorded.
+	ShellEscape string
+}
+
+var errIdleTimeout = errors.New("jcli: idle timeout")
+
+// prompter is the part of *liner.State used by the loop.
+type prompter interface {
+	Prompt(prompt string) (string, error)
+	AppendHistory(item string)
+}
+
+// RunLoop runs the commands entered at the prompt until exit or quit. The commands
+// share a Session, the one in ctx if any.
 func RunLoop(cli *Cli, ctx context.Context, prompt, historyPath string) error {
+	return RunLoopConfig(cli, ctx, LoopConfig{Prompt: prompt, HistoryPath: historyPath})
+}
+
+// RunLoopConfig is RunLoop with more options.
+func RunLoopConfig(cli *Cli, ctx context.Context, cfg LoopConfig) error {
+	if GetSession(ctx) == nil {
+		ctx = WithSession(ctx, NewSession())
+	}
+
 	line := liner.NewLiner()
 
 	defer func() {
@@ -32,7 +73,11 @@ func RunLoop(cli *Cli, ctx context.Context, prompt, historyPath string) error {
 	}()
 
 	line.SetCtrlCAborts(true)
+	line.SetCompleter(func(s string) []string {
+		return cli.completeLine(ctx, s)
+	})
 
+	historyPath := cfg.HistoryPath
 	if historyPath != "" {
 		if f, err := os.Open(historyPath); err == nil {
 			_, _ = line.ReadHistory(f)
@@ -40,9 +85,41 @@ func RunLoop(cli *Cli, ctx context.Context, prompt, historyPath string) error {
 		}
 	}
 
-	prompt = fmt.Sprintf("[%s] ", prompt)
+	runLoop(cli, ctx, cfg, line)
+
+	if historyPath != "" {
+		if f, err := os.Create(historyPath); err != nil {
+			fmt.Print("Error writing history file: ", err)
+		} else {
+			_, _ = line.WriteHistory(f)
+			f.Close()
+		}
+	}
+
+	return nil
+}
+
+func runLoop(cli *Cli, ctx context.Context, cfg LoopConfig, line prompter) {
+	prompt := fmt.Sprintf("[%s] ", cfg.Prompt)
+
+	var record *os.File
+	if cfg.RecordPath != "" {
+		f, err := os.OpenFile(cfg.RecordPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			fmt.Println("Error opening record file: ", err)
+		} else {
+			record = f
+			defer record.Close()
+		}
+	}
+
 	for {
-		cmd, err := line.Prompt(prompt)
+		cmd, err := readLine(line, prompt, cfg.IdleTimeout)
+		if err == errIdleTimeout {
+			fmt.Println("\nIdle for too long, bye")
+			break
+		}
+
 		if err == liner.ErrPromptAborted || err == io.EOF {
 			fmt.Println("Bye")
 			break
@@ -53,6 +130,14 @@ func RunLoop(cli *Cli, ctx context.Context, prompt, historyPath string) error {
 			continue
 		}
 
+		if shellCmd, ok := shellCommand(cmd, cfg.ShellEscape); ok {
+			if err := runShell(ctx, shellCmd); err != nil {
+				fmt.Println(err)
+			}
+			line.AppendHistory(cmd)
+			continue
+		}
+
 		words := strings.Fields(cmd)
 		if len(words) == 0 {
 			continue
@@ -63,6 +148,12 @@ func RunLoop(cli *Cli, ctx context.Context, prompt, historyPath string) error {
 			break
 		}
 
+		if record != nil {
+			if _, err := fmt.Fprintln(record, cmd); err != nil {
+				fmt.Println("Error recording line: ", err)
+			}
+		}
+
 		if err = cli.Run(ctx, words...); err != nil {
 			if err != ErrHelp {
 				fmt.Println(err)
@@ -71,17 +162,56 @@ func RunLoop(cli *Cli, ctx context.Context, prompt, historyPath string) error {
 
 		line.AppendHistory(cmd)
 	}
+}
 
-	if historyPath != "" {
-		if f, err := os.Create(historyPath); err != nil {
-			fmt.Print("Error writing history file: ", err)
-		} else {
-			_, _ = line.WriteHistory(f)
-			f.Close()
-		}
+// shellCommand returns the shell command of line if it starts with escape,
+// which is non-empty, after any leading spaces.
+func shellCommand(line, escape string) (string, bool) {
+	line = strings.TrimSpace(line)
+	if escape == "" || !strings.HasPrefix(line, escape) {
+		return "", false
+	}
+	return strings.TrimSpace(line[len(escape):]), true
+}
+
+// runShell runs cmd with 'sh -c', with the output to Stdout(ctx) and Stderr(ctx).
+func runShell(ctx context.Context, cmd string) error {
+	if cmd == "" {
+		return nil
 	}
+	sh := exec.CommandContext(ctx, "sh", "-c", cmd)
+	sh.Stdin = Stdin(ctx)
+	sh.Stdout = Stdout(ctx)
+	sh.Stderr = Stderr(ctx)
+	return sh.Run()
+}
 
-	return nil
+// readLine prompts for a line, returning errIdleTimeout if none is entered
+// within timeout, if positive. As the prompt cannot be interrupted, it is left
+// pending in the background on timeout, and the loop should end.
+func readLine(line prompter, prompt string, timeout time.Duration) (string, error) {
+	if timeout <= 0 {
+		return line.Prompt(prompt)
+	}
+
+	type result struct {
+		line string
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		cmd, err := line.Prompt(prompt)
+		ch <- result{cmd, err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case r := <-ch:
+		return r.line, r.err
+	case <-timer.C:
+		return "", errIdleTimeout
+	}
 }
 
 // utils
@@ -0,0 +1,94 @@
+// Copyright (c) 2021 Jing-Ying Chen. Subject to the MIT License.
+
+package jcli
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxSamples is the number of latest latencies kept per command for percentiles.
+const maxSamples = 1000
+
+// CommandMetrics is the aggregate of the runs of the action of a command, with
+// the latency percentiles over the latest runs.
+type CommandMetrics struct {
+	Count int
+	P50   time.Duration
+	P95   time.Duration
+}
+
+// metrics accumulates the latencies of actions by command path.
+type metrics struct {
+	mu      sync.Mutex
+	counts  map[string]int
+	samples map[string][]time.Duration // ring buffers of at most maxSamples
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		counts:  make(map[string]int),
+		samples: make(map[string][]time.Duration),
+	}
+}
+
+func (m *metrics) record(path string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := m.counts[path]
+	m.counts[path] = n + 1
+	if samples := m.samples[path]; len(samples) < maxSamples {
+		m.samples[path] = append(samples, d)
+	} else {
+		samples[n%maxSamples] = d
+	}
+}
+
+func (m *metrics) snapshot() map[string]CommandMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ret := make(map[string]CommandMetrics, len(m.counts))
+	for path, count := range m.counts {
+		sorted := append([]time.Duration{}, m.samples[path]...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		ret[path] = CommandMetrics{
+			Count: count,
+			P50:   percentile(sorted, 50),
+			P95:   percentile(sorted, 95),
+		}
+	}
+	return ret
+}
+
+// percentile returns the p-th percentile of the sorted durations, by the
+// nearest-rank method.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// CollectMetrics - Sets whether the latencies of actions are accumulated by
+// command path, for Metrics. It is off by default.
+func (c *Cli) CollectMetrics(enabled bool) *Cli {
+	c.metrics = nil
+	if enabled {
+		c.metrics = newMetrics()
+	}
+	return c
+}
+
+// Metrics - Returns the number of runs and latency percentiles of the actions
+// by command path, as collected since CollectMetrics, or nil if not enabled.
+func (c *Cli) Metrics() map[string]CommandMetrics {
+	if c.metrics == nil {
+		return nil
+	}
+	return c.metrics.snapshot()
+}
@@ -0,0 +1,41 @@
+// Copyright (c) 2021 Jing-Ying Chen. Subject to the MIT License.
+
+package jcli
+
+import (
+	"fmt"
+	"plugin"
+)
+
+// PluginSymbol is the symbol a plugin exports to provide its commands, which
+// must be a function of type func() []*Command.
+const PluginSymbol = "Commands"
+
+// pluginLookup is the part of *plugin.Plugin used to find the symbol.
+type pluginLookup interface {
+	Lookup(name string) (plugin.Symbol, error)
+}
+
+// openPlugin opens the plugin at path; replaced in tests.
+var openPlugin = func(path string) (pluginLookup, error) {
+	return plugin.Open(path)
+}
+
+// LoadPlugin - Opens the Go plugin at path and adds the commands returned by its
+// Commands function to the application.
+func (c *Cli) LoadPlugin(path string) error {
+	p, err := openPlugin(path)
+	if err != nil {
+		return fmt.Errorf("Cannot load plugin '%s': %w", path, err)
+	}
+	sym, err := p.Lookup(PluginSymbol)
+	if err != nil {
+		return fmt.Errorf("Cannot find '%s' in plugin '%s': %w", PluginSymbol, path, err)
+	}
+	fn, ok := sym.(func() []*Command)
+	if !ok {
+		return fmt.Errorf("Symbol '%s' in plugin '%s' is %T, not func() []*Command", PluginSymbol, path, sym)
+	}
+	c.Commands(fn()...)
+	return nil
+}
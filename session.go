@@ -0,0 +1,53 @@
+// Copyright (c) 2021 Jing-Ying Chen. Subject to the MIT License.
+
+package jcli
+
+import (
+	"context"
+	"sync"
+)
+
+const (
+	SessionKey = "__session__"
+)
+
+// Session holds state shared by the commands run in a session, such as in
+// RunLoop. It is safe for concurrent use.
+type Session struct {
+	mu     sync.RWMutex
+	values map[string]interface{}
+}
+
+func NewSession() *Session {
+	return &Session{values: make(map[string]interface{})}
+}
+
+func (s *Session) Get(key string) (interface{}, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	val, ok := s.values[key]
+	return val, ok
+}
+
+func (s *Session) Set(key string, val interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[key] = val
+}
+
+func (s *Session) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, key)
+}
+
+func WithSession(ctx context.Context, s *Session) context.Context {
+	return context.WithValue(ctx, SessionKey, s)
+}
+
+func GetSession(ctx context.Context) *Session {
+	if s, ok := ctx.Value(SessionKey).(*Session); ok {
+		return s
+	}
+	return nil
+}
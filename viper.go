@@ -4,14 +4,19 @@ package jcli
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
 	"reflect"
 
 	"github.com/spf13/viper"
 )
 
 const (
-	ViperKey = "__viper__"
+	ViperKey          = "__viper__"
+	ViperNamespaceKey = "__viper_namespace__"
 )
 
 func WithViper(ctx context.Context, vip *viper.Viper) context.Context {
@@ -25,14 +30,30 @@ func GetViper(ctx context.Context) *viper.Viper {
 	return nil
 }
 
+// ViperNamespace returns the prefix of the viper keys of the running command,
+// as set by Command.ViperNamespace, or "" if none.
+func ViperNamespace(ctx context.Context) string {
+	ns, _ := ctx.Value(ViperNamespaceKey).(string)
+	return ns
+}
+
+// namespacedKey returns key prefixed by the viper namespace in ctx, if any.
+func namespacedKey(ctx context.Context, key string) string {
+	if ns := ViperNamespace(ctx); ns != "" {
+		return ns + "." + key
+	}
+	return key
+}
+
 // GetStringOrViper gets the value from the context using the key; if fails, tries
-// to get the viper instance from the context then uses viperKey to get the value.
+// to get the viper instance from the context then uses viperKey, prefixed by the
+// ViperNamespace if any, to get the value. So do the other XxxOrViper helpers.
 func GetStringOrViper(ctx context.Context, key, viperKey string) string {
 	if val, ok := ctx.Value(key).(string); ok {
 		return val
 	}
 	if vip := GetViper(ctx); vip != nil {
-		return vip.GetString(viperKey)
+		return vip.GetString(namespacedKey(ctx, viperKey))
 	}
 	return ""
 }
@@ -42,7 +63,7 @@ func GetIntOrViper(ctx context.Context, key string, viperKey string) int {
 		return val
 	}
 	if vip := GetViper(ctx); vip != nil {
-		return vip.GetInt(viperKey)
+		return vip.GetInt(namespacedKey(ctx, viperKey))
 	}
 	return 0
 }
@@ -52,7 +73,7 @@ func GetBoolOrViper(ctx context.Context, key string, viperKey string) bool {
 		return val
 	}
 	if vip := GetViper(ctx); vip != nil {
-		return vip.GetBool(viperKey)
+		return vip.GetBool(namespacedKey(ctx, viperKey))
 	}
 	return false
 }
@@ -62,14 +83,14 @@ func GetFloatOrViper(ctx context.Context, key string, viperKey string) float64 {
 		return val
 	}
 	if vip := GetViper(ctx); vip != nil {
-		return vip.GetFloat64(viperKey)
+		return vip.GetFloat64(namespacedKey(ctx, viperKey))
 	}
 	return 0
 }
 
 func StringFlagOrViper(ctx context.Context, key string, viperKey string) string {
 	val := StringFlag(ctx, key, "")
-	return StringOrViper(val, GetViper(ctx), viperKey)
+	return StringOrViper(val, GetViper(ctx), namespacedKey(ctx, viperKey))
 }
 
 func GetStringMap(ctx context.Context, key string) map[string]interface{} {
@@ -154,20 +175,34 @@ type ViperConfig struct {
 	ConfigPaths []string
 }
 
+// NewViper reads the config given by cfg. Without ConfigType, the type is
+// inferred from the extension of ConfigFile, or of the file named ConfigName
+// that viper finds in ConfigPaths, defaulting to yaml.
 func NewViper(cfg ViperConfig) (*viper.Viper, error) {
 	var vip *viper.Viper
 	if cfg.ConfigFile != "" { // in cfg or from command flag
 		vip = viper.New()
 		vip.SetConfigFile(cfg.ConfigFile)
+
+		ct := cfg.ConfigType
+		if ct == "" && filepath.Ext(cfg.ConfigFile) == "" {
+			ct = "yaml"
+		}
+		if ct != "" {
+			vip.SetConfigType(ct)
+		}
 	} else if cfg.ConfigName != "" && len(cfg.ConfigPaths) > 0 {
 		vip = viper.New()
 		vip.SetConfigName(cfg.ConfigName)
 
+		// Leave the type to viper when it finds a file with a known extension
 		ct := cfg.ConfigType
-		if ct == "" {
+		if ct == "" && !hasConfigFile(cfg.ConfigName, cfg.ConfigPaths) {
 			ct = "yaml"
 		}
-		vip.SetConfigType(ct)
+		if ct != "" {
+			vip.SetConfigType(ct)
+		}
 
 		for _, cp := range cfg.ConfigPaths {
 			vip.AddConfigPath(cp)
@@ -186,3 +221,35 @@ func NewViper(cfg ViperConfig) (*viper.Viper, error) {
 
 	return vip, nil
 }
+
+// hasConfigFile returns whether there is a config file named name with one of
+// the extensions supported by viper in paths.
+func hasConfigFile(name string, paths []string) bool {
+	for _, pth := range paths {
+		for _, ext := range viper.SupportedExts {
+			if _, err := os.Stat(filepath.Join(pth, name+"."+ext)); err == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// NewViperMerged reads the given config files in order, later ones overriding
+// earlier ones, e.g. for system, user and project configs. Missing files are
+// skipped.
+func NewViperMerged(files ...string) (*viper.Viper, error) {
+	vip := viper.New()
+	for _, file := range files {
+		if _, err := os.Stat(file); errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		vip.SetConfigFile(file)
+		if err := vip.MergeInConfig(); err != nil {
+			return nil, err
+		}
+	}
+
+	vip.AutomaticEnv()
+	return vip, nil
+}